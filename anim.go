@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/disintegration/imaging"
+)
+
+// upper bound of frames rendered for a single request
+const maxFrames = 300
+
+// frameRange describes a sequence of frames of an animated svg
+type frameRange struct {
+	start, end, fps float64
+	format          string // apng, gif or zip
+}
+
+// parseFrameRange reads start, end, fps and format from the query. ok is
+// false if no frame sequence was requested.
+func parseFrameRange(q url.Values) (fr frameRange, ok bool, err error) {
+	if q.Get("end") == "" && q.Get("fps") == "" {
+		return fr, false, nil
+	}
+	fr = frameRange{fps: 10, format: "apng"}
+	for _, p := range []struct {
+		name string
+		v    *float64
+	}{{"start", &fr.start}, {"end", &fr.end}, {"fps", &fr.fps}} {
+		if s := q.Get(p.name); s != "" {
+			if *p.v, err = strconv.ParseFloat(s, 64); err != nil || *p.v < 0 {
+				return fr, true, fmt.Errorf("invalid %s '%s'", p.name, s)
+			}
+		}
+	}
+	if f := q.Get("format"); f != "" {
+		fr.format = f
+	}
+	switch {
+	case fr.format != "apng" && fr.format != "gif" && fr.format != "zip":
+		return fr, true, fmt.Errorf("unsupported frame format '%s'", fr.format)
+	case fr.fps <= 0:
+		return fr, true, fmt.Errorf("fps must be positive")
+	case fr.end <= fr.start:
+		return fr, true, fmt.Errorf("end (%g) must be after start (%g)", fr.end, fr.start)
+	case len(fr.times()) > maxFrames:
+		return fr, true, fmt.Errorf("%d frames requested, at most %d are allowed", len(fr.times()), maxFrames)
+	}
+	return fr, true, nil
+}
+
+// times returns the animation offsets of all frames in seconds
+func (fr frameRange) times() []float64 {
+	n := int(math.Ceil((fr.end - fr.start) * fr.fps))
+	if n > maxFrames+1 {
+		n = maxFrames + 1
+	}
+	times := make([]float64, n)
+	for i := range times {
+		times[i] = fr.start + float64(i)/fr.fps
+	}
+	return times
+}
+
+// delay returns the duration of a single frame in 1/100 s
+func (fr frameRange) delay() int {
+	return int(math.Round(100 / fr.fps))
+}
+
+// frameHandler renders all frames of fr as variations of base and responds
+// with them in the requested format, with the watermark applied if not nil
+func frameHandler(w http.ResponseWriter, r *http.Request, rd *renderer, body []byte, size svgSize, base shot, fr frameRange, wm *watermark) {
+	times := fr.times()
+	shots := make([]shot, len(times))
+	names := make([]string, len(times))
+	for i, t := range times {
+		shots[i] = shot{params: url.Values{}, scale: base.scale, budget: base.budget}
+		for k, v := range base.params {
+			shots[i].params[k] = v
+		}
+		shots[i].params.Set("t", strconv.FormatFloat(t, 'f', -1, 64))
+		names[i] = fmt.Sprintf("frame-%04d.png", i)
+	}
+	res, err := rd.render(r.Context(), body, size, shots...)
+	if err != nil {
+		logrus.Warn(err)
+		writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	for i := range res {
+		if res[i], err = postProcess(res[i], postOptions{watermark: wm}); err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	var contentType string
+	switch fr.format {
+	case "zip":
+		contentType = "application/zip"
+		err = writeZip(&buf, names, res)
+	case "gif", "apng":
+		var frames []*image.NRGBA
+		if frames, err = decodeFrames(res); err != nil {
+			break
+		}
+		if fr.format == "gif" {
+			contentType = "image/gif"
+			err = encodeGIF(&buf, frames, fr.delay())
+		} else {
+			contentType = "image/apng"
+			err = encodeAPNG(&buf, frames, fr.delay())
+		}
+	}
+	if err != nil {
+		logrus.Warn(err)
+		writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	if fr.format == "zip" {
+		w.Header().Set("Content-Disposition", `attachment; filename="frames.zip"`)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf.Bytes())
+}
+
+// decodeFrames decodes rendered frames and pads them to a common size, as the
+// bounding box of an animated element may change between frames.
+func decodeFrames(pngs [][]byte) ([]*image.NRGBA, error) {
+	frames := make([]*image.NRGBA, len(pngs))
+	var w, h int
+	for i, p := range pngs {
+		img, err := png.Decode(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		frames[i] = imaging.Clone(img)
+		if b := img.Bounds(); b.Dx() > w {
+			w = b.Dx()
+		}
+		if b := img.Bounds(); b.Dy() > h {
+			h = b.Dy()
+		}
+	}
+	for i, f := range frames {
+		if f.Bounds().Dx() != w || f.Bounds().Dy() != h {
+			frames[i] = imaging.Paste(imaging.New(w, h, color.Transparent), f, image.Point{})
+		}
+	}
+	return frames, nil
+}
+
+// encodeGIF encodes frames as animated gif using the web safe palette plus
+// a transparent color
+func encodeGIF(w io.Writer, frames []*image.NRGBA, delay int) error {
+	pal := append(color.Palette{color.Transparent}, palette.WebSafe...)
+	anim := &gif.GIF{}
+	for _, f := range frames {
+		p := image.NewPaletted(f.Bounds(), pal)
+		draw.FloydSteinberg.Draw(p, f.Bounds(), f, image.Point{})
+		anim.Image = append(anim.Image, p)
+		anim.Delay = append(anim.Delay, delay)
+		anim.Disposal = append(anim.Disposal, gif.DisposalBackground)
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// encodeAPNG encodes frames as animated png. All frames are stored as 8 bit
+// RGBA, so they share the header of the first frame.
+func encodeAPNG(w io.Writer, frames []*image.NRGBA, delay int) error {
+	if len(frames) == 0 {
+		return fmt.Errorf("no frames to encode")
+	}
+	b := frames[0].Bounds()
+	if _, err := w.Write(pngSignature); err != nil {
+		return err
+	}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(b.Dy()))
+	ihdr[8], ihdr[9] = 8, 6 // bit depth, color type RGBA
+	if err := writeChunk(w, "IHDR", ihdr); err != nil {
+		return err
+	}
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(frames)))
+	if err := writeChunk(w, "acTL", actl); err != nil {
+		return err
+	}
+
+	seq := uint32(0)
+	for i, f := range frames {
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(b.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(b.Dy()))
+		binary.BigEndian.PutUint16(fctl[20:], uint16(delay))
+		binary.BigEndian.PutUint16(fctl[22:], 100)
+		fctl[24] = 1 // dispose to transparent black
+		if err := writeChunk(w, "fcTL", fctl); err != nil {
+			return err
+		}
+		seq++
+
+		data, err := compressRGBA(f)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			err = writeChunk(w, "IDAT", data)
+		} else {
+			fdat := make([]byte, 4, 4+len(data))
+			binary.BigEndian.PutUint32(fdat, seq)
+			err = writeChunk(w, "fdAT", append(fdat, data...))
+			seq++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return writeChunk(w, "IEND", nil)
+}
+
+// compressRGBA returns the zlib compressed, unfiltered scanlines of img
+func compressRGBA(img *image.NRGBA) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	b := img.Bounds()
+	row := make([]byte, 1+4*b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := img.PixOffset(b.Min.X, y)
+		copy(row[1:], img.Pix[i:i+4*b.Dx()])
+		if _, err := zw.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
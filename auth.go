@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// apiKey is a client of the service with its own limits. 0 or empty disables
+// a limit.
+type apiKey struct {
+	Key            string   `json:"key"`
+	Name           string   `json:"name,omitempty"`
+	RPM            int      `json:"rpm,omitempty"`              // requests per minute
+	Concurrency    int      `json:"concurrency,omitempty"`      // requests at a time
+	MaxPixels      float64  `json:"max_pixels,omitempty"`       // of a rendered image
+	MaxTotalPixels float64  `json:"max_total_pixels,omitempty"` // of all images of a request
+	Formats        []string `json:"formats,omitempty"`          // allowed formats
+	Watermark      string   `json:"watermark,omitempty"`        // enforced, see parseWatermark
+}
+
+// allows reports whether the key may request the format
+func (k *apiKey) allows(format string) bool {
+	if len(k.Formats) == 0 || format == "" {
+		return true
+	}
+	for _, f := range k.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// keyUsage are the usage counters of a key
+type keyUsage struct {
+	Requests int64 `json:"requests"` // accepted
+	Rejected int64 `json:"rejected"` // by the rate, concurrency or format limits
+	Active   int   `json:"active"`
+	Bytes    int64 `json:"bytes"` // written in responses
+
+	window time.Time // start of the current minute
+	count  int       // requests in the current minute
+}
+
+type keyEntry struct {
+	key   apiKey
+	usage keyUsage
+}
+
+// keyStore holds the api keys. Requests need a key if the store is enabled.
+type keyStore struct {
+	mu    sync.Mutex
+	keys  map[string]*keyEntry
+	admin string // key for the admin api, empty disables it
+}
+
+func NewKeyStore(admin string) *keyStore {
+	return &keyStore{keys: map[string]*keyEntry{}, admin: admin}
+}
+
+// Put adds or replaces a key, keeping its usage
+func (ks *keyStore) Put(k apiKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if e, ok := ks.keys[k.Key]; ok {
+		e.key = k
+		return
+	}
+	ks.keys[k.Key] = &keyEntry{key: k}
+}
+
+// Remove removes a key, it reports whether the key existed
+func (ks *keyStore) Remove(key string) bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	_, ok := ks.keys[key]
+	delete(ks.keys, key)
+	return ok
+}
+
+// Get returns a key, used by the watermark enforcement
+func (ks *keyStore) Get(key string) (apiKey, bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	e, ok := ks.keys[key]
+	if !ok {
+		return apiKey{}, false
+	}
+	return e.key, true
+}
+
+// LoadFile loads the keys of a json file with an array of keys
+func (ks *keyStore) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var keys []apiKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return errors.Wrapf(err, "could not parse '%s'", path)
+	}
+	for _, k := range keys {
+		if k.Key == "" {
+			return fmt.Errorf("key without a key in '%s'", path)
+		}
+		ks.Put(k)
+	}
+	logrus.Infof("loaded %d api keys", len(keys))
+	return nil
+}
+
+// keyUsageEntry is a key with its usage, as returned by the api
+type keyUsageEntry struct {
+	apiKey
+	Usage keyUsage `json:"usage"`
+}
+
+// List returns all keys with their usage
+func (ks *keyStore) List() []keyUsageEntry {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	res := make([]keyUsageEntry, 0, len(ks.keys))
+	for _, e := range ks.keys {
+		res = append(res, keyUsageEntry{e.key, e.usage})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res
+}
+
+// acquire checks the limits of the key for a request of the given format and
+// counts it as active until release is called. For rate limited requests the
+// seconds until the next minute are returned.
+func (ks *keyStore) acquire(key, format string) (apiKey, int, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	e, ok := ks.keys[key]
+	if !ok {
+		return apiKey{}, 0, newError(http.StatusUnauthorized, codeUnauthorized, errors.New("missing or unknown api key"))
+	}
+	u := &e.usage
+	if !e.key.allows(format) {
+		u.Rejected++
+		return e.key, 0, newError(http.StatusForbidden, codeForbidden, fmt.Errorf("format '%s' is not allowed for this api key", format))
+	}
+	now := time.Now()
+	if now.Sub(u.window) >= time.Minute {
+		u.window, u.count = now.Truncate(time.Minute), 0
+	}
+	if e.key.RPM > 0 && u.count >= e.key.RPM {
+		u.Rejected++
+		retry := int(u.window.Add(time.Minute).Sub(now).Seconds()) + 1
+		return e.key, retry, newError(http.StatusTooManyRequests, codeRateLimited, fmt.Errorf("more than %d requests per minute", e.key.RPM))
+	}
+	if e.key.Concurrency > 0 && u.Active >= e.key.Concurrency {
+		u.Rejected++
+		return e.key, 1, newError(http.StatusTooManyRequests, codeRateLimited, fmt.Errorf("more than %d concurrent requests", e.key.Concurrency))
+	}
+	u.count++
+	u.Requests++
+	u.Active++
+	return e.key, 0, nil
+}
+
+// release ends a request of acquire, counting the bytes written
+func (ks *keyStore) release(key string, written int64) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if e, ok := ks.keys[key]; ok {
+		e.usage.Active--
+		e.usage.Bytes += written
+	}
+}
+
+// requestKey returns the api key of the request, from the X-API-Key header
+// or a bearer token
+func requestKey(r *http.Request) string {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return k
+	}
+	if a := r.Header.Get("Authorization"); len(a) > 7 && strings.EqualFold(a[:7], "bearer ") {
+		return strings.TrimSpace(a[7:])
+	}
+	return ""
+}
+
+// isAdmin reports whether the request has the admin key
+func (ks *keyStore) isAdmin(r *http.Request) bool {
+	if ks == nil || ks.admin == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(requestKey(r)), []byte(ks.admin)) == 1
+}
+
+type apiKeyKey struct{}
+
+// keyLimits returns the limits of the api key of the request, see require
+func keyLimits(r *http.Request) limits {
+	k, _ := r.Context().Value(apiKeyKey{}).(apiKey)
+	return limits{pixels: k.MaxPixels, total: k.MaxTotalPixels}
+}
+
+// keyAllows reports whether the api key of the request may request the format
+func keyAllows(r *http.Request, format string) bool {
+	k, ok := r.Context().Value(apiKeyKey{}).(apiKey)
+	return !ok || k.allows(format)
+}
+
+// countingWriter counts the bytes of a response
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// require runs h only for requests with a key that may request the format
+// (any if empty) within its limits. A nil store lets all requests through.
+func (ks *keyStore) require(format string, h http.HandlerFunc) http.HandlerFunc {
+	if ks == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		k, retry, err := ks.acquire(requestKey(r), format)
+		if err != nil {
+			logrus.Warn(err)
+			if retry > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(retry))
+			}
+			writeError(w, r, err, http.StatusUnauthorized)
+			return
+		}
+		cw := &countingWriter{ResponseWriter: w}
+		defer func() { ks.release(k.Key, cw.n) }()
+		h(cw, r.WithContext(context.WithValue(r.Context(), apiKeyKey{}, k)))
+	}
+}
+
+// usageHandler returns the key and usage of the request's api key
+func usageHandler(ks *keyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := requestKey(r)
+		for _, e := range ks.List() {
+			if e.Key == key {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(e)
+				return
+			}
+		}
+		writeError(w, r, errors.New("missing or unknown api key"), http.StatusUnauthorized)
+	}
+}
+
+// keyHandler is the admin api of the keys, authenticated with the admin key:
+// GET /v1/keys lists the keys with their usage, PUT /v1/keys/{key} adds or
+// replaces a key and DELETE /v1/keys/{key} removes it
+func keyHandler(ks *keyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ks.isAdmin(r) {
+			writeError(w, r, newError(http.StatusUnauthorized, codeUnauthorized, errors.New("missing or wrong admin key")), http.StatusUnauthorized)
+			return
+		}
+		key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/keys"), "/")
+		switch {
+		case key == "" && r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ks.List())
+		case key != "" && r.Method == http.MethodPut:
+			var k apiKey
+			if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, errors.Wrap(err, "invalid json"), http.StatusBadRequest)
+				return
+			}
+			k.Key = key
+			ks.Put(k)
+			w.WriteHeader(http.StatusNoContent)
+		case key != "" && r.Method == http.MethodDelete:
+			if !ks.Remove(key) {
+				writeError(w, r, errors.New("key not found"), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pkg/errors"
+)
+
+// gzipMagic starts every gzip stream, e.g. svgz files
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompress decodes data sent with the given Content-Encoding (gzip or br),
+// or gzip data that is detected by its magic bytes. The decompressed size is
+// limited to limit bytes, 0 disables the limit.
+func decompress(data []byte, encoding string, limit int64) ([]byte, error) {
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		if !bytes.HasPrefix(data, gzipMagic) {
+			return data, nil
+		}
+		fallthrough
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, newError(http.StatusBadRequest, codeInvalidRequest, errors.Wrap(err, "could not decompress body"))
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(data))
+	default:
+		return nil, newError(http.StatusUnsupportedMediaType, codeUnsupportedEncoding,
+			fmt.Errorf("unsupported Content-Encoding '%s', only gzip and br are supported", encoding))
+	}
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	res, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, codeInvalidRequest, errors.Wrap(err, "could not decompress body"))
+	}
+	if limit > 0 && int64(len(res)) > limit {
+		return nil, &limitError{
+			status: http.StatusRequestEntityTooLarge,
+			Reason: fmt.Sprintf("decompressed body is larger than %d bytes", limit),
+			Limit:  float64(limit),
+		}
+	}
+	return res, nil
+}
+
+// gzipTypes are the content types of responses that are compressed
+var gzipTypes = map[string]bool{
+	"application/json": true,
+	"image/svg+xml":    true,
+}
+
+// acceptsGzip reports whether the Accept-Encoding of r allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(e, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		if len(parts) > 1 && strings.Replace(parts[1], " ", "", -1) == "q=0" {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter compresses json and svg responses, decided by the Content-Type
+// when the header is written
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if !g.decided {
+		g.decided = true
+		h := g.Header()
+		ct, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+		if gzipTypes[ct] {
+			h.Add("Vary", "Accept-Encoding")
+			if h.Get("Content-Encoding") == "" && status != http.StatusNoContent && status != http.StatusNotModified {
+				h.Del("Content-Length")
+				h.Set("Content-Encoding", "gzip")
+				g.gz = gzip.NewWriter(g.ResponseWriter)
+			}
+		}
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if !g.decided {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// withGzip compresses json and svg responses for clients accepting gzip
+func withGzip(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		g := &gzipWriter{ResponseWriter: w}
+		defer func() {
+			if g.gz != nil {
+				g.gz.Close()
+			}
+		}()
+		h.ServeHTTP(g, r)
+	})
+}
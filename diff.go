@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+)
+
+// jndDeltaE is the just noticeable difference in CIE76, pixels closer than
+// this are considered unchanged
+const jndDeltaE = 2.3
+
+// diffResult is returned by /v1/diff
+type diffResult struct {
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	Changed   int     `json:"changed"`
+	Percent   float64 `json:"percent"`
+	Distance  float64 `json:"distance"` // mean CIE76 delta E over all pixels
+	Threshold float64 `json:"threshold"`
+	Pass      bool    `json:"pass"`
+	Diff      []byte  `json:"diff"` // png, base64 encoded in json
+}
+
+// lab converts a color composited over white to CIE L*a*b* (D65)
+func lab(c color.NRGBA) [3]float64 {
+	a := float64(c.A) / 255
+	lin := func(v uint8) float64 {
+		s := float64(v)/255*a + 1 - a
+		if s <= 0.04045 {
+			return s / 12.92
+		}
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+	r, g, b := lin(c.R), lin(c.G), lin(c.B)
+	x := (0.4124*r + 0.3576*g + 0.1805*b) / 0.95047
+	y := 0.2126*r + 0.7152*g + 0.0722*b
+	z := (0.0193*r + 0.1192*g + 0.9505*b) / 1.08883
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+func deltaE(c1, c2 color.NRGBA) float64 {
+	l1, l2 := lab(c1), lab(c2)
+	return math.Sqrt((l1[0]-l2[0])*(l1[0]-l2[0]) + (l1[1]-l2[1])*(l1[1]-l2[1]) + (l1[2]-l2[2])*(l1[2]-l2[2]))
+}
+
+// diffImages compares a and b pixel by pixel. Images of different size are
+// compared over the union of both, missing pixels count as transparent.
+// The diff image shows a faded grayscale version of a with the changed
+// pixels in red.
+func diffImages(a, b image.Image) (diffResult, image.Image) {
+	na, nb := imaging.Clone(a), imaging.Clone(b)
+	w, h := na.Bounds().Dx(), na.Bounds().Dy()
+	if nb.Bounds().Dx() > w {
+		w = nb.Bounds().Dx()
+	}
+	if nb.Bounds().Dy() > h {
+		h = nb.Bounds().Dy()
+	}
+	at := func(img *image.NRGBA, x, y int) color.NRGBA {
+		if !image.Pt(x, y).In(img.Bounds()) {
+			return color.NRGBA{}
+		}
+		return img.NRGBAAt(x, y)
+	}
+
+	res := diffResult{Width: w, Height: h}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	sum := 0.0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			ca, cb := at(na, x, y), at(nb, x, y)
+			d := deltaE(ca, cb)
+			sum += d
+			if d > jndDeltaE {
+				res.Changed++
+				dst.SetNRGBA(x, y, color.NRGBA{255, 0, 0, 255})
+				continue
+			}
+			gray := uint8(255 - (255-lab(ca)[0]*2.55)/4)
+			dst.SetNRGBA(x, y, color.NRGBA{gray, gray, gray, 255})
+		}
+	}
+	if w*h > 0 {
+		res.Percent = float64(res.Changed) * 100 / float64(w*h)
+		res.Distance = sum / float64(w*h)
+	}
+	return res, dst
+}
+
+// readFormFile returns the content of a multipart form file
+func readFormFile(r *http.Request, name string) ([]byte, error) {
+	f, _, err := r.FormFile(name)
+	if err == http.ErrMissingFile {
+		return nil, fmt.Errorf("missing form file '%s'", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// diffHandler renders the svg and the reference with the same options and
+// compares them. The reference is either another svg or a png. The request
+// passes if at most threshold percent of the pixels changed.
+func diffHandler(rd *renderer, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		if cfg.limits.bodySize > 0 {
+			r.Body = http.MaxBytesReader(w, body, cfg.limits.bodySize)
+		}
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			logrus.Warn(err)
+			if cfg.limits.bodySize > 0 && body.n > cfg.limits.bodySize {
+				err = cfg.limits.bodyTooLarge()
+			}
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		threshold := 0.0
+		if s := r.URL.Query().Get("threshold"); s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil || v < 0 || v > 100 {
+				err = fmt.Errorf("invalid threshold '%s', must be between 0 and 100", s)
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusBadRequest)
+				return
+			}
+			threshold = v
+		}
+
+		var imgs [2]image.Image
+		total := 0.0
+		for i, name := range []string{"svg", "reference"} {
+			data, err := readFormFile(r, name)
+			if err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusBadRequest)
+				return
+			}
+			if i == 1 && bytes.HasPrefix(data, pngSignature) {
+				c, err := png.DecodeConfig(bytes.NewReader(data))
+				if err == nil {
+					err = cfg.limits.checkPixels(float64(c.Width), float64(c.Height))
+				}
+				if err == nil {
+					err = keyLimits(r).checkPixels(float64(c.Width), float64(c.Height))
+				}
+				if err == nil {
+					err = cfg.checkTotal(r, total+float64(c.Width)*float64(c.Height))
+				}
+				if err != nil {
+					logrus.Warn(err)
+					writeError(w, r, errors.Wrap(err, name), http.StatusBadRequest)
+					return
+				}
+				if imgs[i], err = png.Decode(bytes.NewReader(data)); err != nil {
+					logrus.Warn(err)
+					writeError(w, r, err, http.StatusBadRequest)
+					return
+				}
+				continue
+			}
+			size, s, err := keySVGParams(r, data, r.URL.Query(), cfg)
+			if err != nil {
+				logrus.Warn(err)
+				writeError(w, r, errors.Wrap(err, name), http.StatusBadRequest)
+				return
+			}
+			post, err := cfg.postOptions(r, size, s)
+			if err != nil {
+				logrus.Warn(err)
+				writeError(w, r, errors.Wrap(err, name), http.StatusBadRequest)
+				return
+			}
+			pw, ph := post.outputSize(s.imageSize(size))
+			total += pw * ph
+			if err := cfg.checkTotal(r, total); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, errors.Wrap(err, name), http.StatusUnprocessableEntity)
+				return
+			}
+			res, err := rd.render(r.Context(), data, size, s)
+			if err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			out, err := postProcess(res[0], post)
+			if err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			if imgs[i], err = png.Decode(bytes.NewReader(out)); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		res, diff := diffImages(imgs[0], imgs[1])
+		res.Threshold = threshold
+		res.Pass = res.Percent <= threshold
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, diff); err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		res.Diff = buf.Bytes()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
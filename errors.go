@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// error codes returned to clients, see apiError
+const (
+	codeInvalidRequest      = "invalid_request"
+	codeInvalidSVG          = "invalid_svg"
+	codeNotFound            = "not_found"
+	codeMethodNotAllowed    = "method_not_allowed"
+	codeTooLarge            = "too_large"
+	codeUnsupported         = "unsupported"
+	codeAssetBlocked        = "asset_blocked"
+	codeFetchFailed         = "fetch_failed"
+	codeUnsupportedEncoding = "unsupported_encoding"
+	codeUnauthorized        = "unauthorized"
+	codeForbidden           = "forbidden"
+	codeRateLimited         = "rate_limited"
+	codeRenderTimeout       = "render_timeout"
+	codeRenderFailed        = "render_failed"
+	codeChromeUnavailable   = "chrome_unavailable"
+	codeCanceled            = "canceled"
+	codeInternal            = "internal"
+)
+
+// codes used for errors that only carry a status
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            codeInvalidRequest,
+	http.StatusUnauthorized:          codeUnauthorized,
+	http.StatusForbidden:             codeAssetBlocked,
+	http.StatusNotFound:              codeNotFound,
+	http.StatusMethodNotAllowed:      codeMethodNotAllowed,
+	http.StatusRequestEntityTooLarge: codeTooLarge,
+	http.StatusUnsupportedMediaType:  codeUnsupportedEncoding,
+	http.StatusUnprocessableEntity:   codeUnsupported,
+	http.StatusTooManyRequests:       codeRateLimited,
+	http.StatusBadGateway:            codeFetchFailed,
+	http.StatusServiceUnavailable:    codeChromeUnavailable,
+	http.StatusGatewayTimeout:        codeRenderTimeout,
+}
+
+// apiError is the json body of all error responses
+type apiError struct {
+	status    int
+	Code      string  `json:"code"`
+	Message   string  `json:"message"`
+	RequestID string  `json:"request_id,omitempty"`
+	Limit     float64 `json:"limit,omitempty"`
+	Actual    float64 `json:"actual,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// newError returns an error with the given status and code
+func newError(status int, code string, err error) *apiError {
+	return &apiError{status: status, Code: code, Message: err.Error()}
+}
+
+// classify maps err to an apiError. status is used for errors that do not
+// carry one themselves.
+func classify(err error, status int) *apiError {
+	cause := errors.Cause(err)
+	switch e := cause.(type) {
+	case *apiError:
+		res := *e
+		res.Message = err.Error()
+		return &res
+	case *limitError:
+		return &apiError{status: e.status, Code: codeTooLarge, Message: err.Error(), Limit: e.Limit, Actual: e.Actual}
+	case unsupportedError:
+		return &apiError{status: http.StatusUnprocessableEntity, Code: codeUnsupported, Message: err.Error()}
+	case net.Error:
+		if e.Timeout() {
+			return &apiError{status: http.StatusGatewayTimeout, Code: codeRenderTimeout, Message: err.Error()}
+		}
+		return &apiError{status: http.StatusServiceUnavailable, Code: codeChromeUnavailable, Message: err.Error()}
+	}
+	switch cause {
+	case context.DeadlineExceeded:
+		return &apiError{status: http.StatusGatewayTimeout, Code: codeRenderTimeout, Message: err.Error()}
+	case context.Canceled:
+		return &apiError{status: http.StatusServiceUnavailable, Code: codeCanceled, Message: err.Error()}
+	}
+	code, ok := statusCodes[status]
+	if !ok {
+		code = codeInternal
+	}
+	return &apiError{status: status, Code: code, Message: err.Error()}
+}
+
+// writeError responds with err as json
+func writeError(w http.ResponseWriter, r *http.Request, err error, status int) {
+	e := classify(err, status)
+	e.RequestID = requestID(r)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(e)
+}
+
+type requestIDKey struct{}
+
+var requestIDRE = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID assigns every request an id, taken from the X-Request-ID
+// header if it is sane, and returns it in the response
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRE.MatchString(id) {
+			var b [8]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the id assigned by withRequestID
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// chromeError classifies an error returned by chrome. Failures to talk to
+// chrome at all mean it is unavailable.
+func chromeError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return errors.Wrap(ctx.Err(), err.Error())
+	}
+	switch errors.Cause(err).(type) {
+	case *apiError, *limitError, net.Error:
+		return err
+	}
+	msg := err.Error()
+	for _, s := range []string{"websocket", "connection refused", "broken pipe", "EOF"} {
+		if strings.Contains(msg, s) {
+			return newError(http.StatusServiceUnavailable, codeChromeUnavailable, err)
+		}
+	}
+	return newError(http.StatusInternalServerError, codeRenderFailed, err)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fetcher downloads svgs from allowed hosts for the src parameter and caches
+// them as allowed by their Cache-Control and ETag headers
+type fetcher struct {
+	hosts   []string // exact host names, or domains with a leading dot
+	client  *http.Client
+	maxSize int64 // bytes, 0 disables the limit
+
+	mu        sync.Mutex
+	cache     map[string]*cachedSVG
+	cacheSize int // entries, 0 disables the cache
+}
+
+// cachedSVG is a fetched svg, fresh until expires and revalidated with its
+// etag afterwards
+type cachedSVG struct {
+	data    []byte
+	etag    string
+	expires time.Time
+	used    time.Time
+}
+
+func NewFetcher(hosts []string, timeout time.Duration, redirects int, cacheSize int, maxSize int64) *fetcher {
+	f := &fetcher{
+		hosts:     hosts,
+		maxSize:   maxSize,
+		cache:     map[string]*cachedSVG{},
+		cacheSize: cacheSize,
+	}
+	f.client = &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > redirects {
+				return fmt.Errorf("more than %d redirects", redirects)
+			}
+			return f.check(req.URL)
+		},
+	}
+	return f
+}
+
+// parseHosts reads the -src-hosts flag, *.example.com allows all subdomains
+func parseHosts(s string) []string {
+	var hosts []string
+	for _, h := range strings.Split(s, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" {
+			hosts = append(hosts, strings.TrimPrefix(h, "*"))
+		}
+	}
+	return hosts
+}
+
+// check returns an asset_blocked error unless u is an http(s) url on one of
+// the allowed hosts
+func (f *fetcher) check(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return newError(http.StatusForbidden, codeAssetBlocked, fmt.Errorf("scheme of '%s' is not allowed", u))
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, h := range f.hosts {
+		if host == h || strings.HasPrefix(h, ".") && strings.HasSuffix(host, h) {
+			return nil
+		}
+	}
+	return newError(http.StatusForbidden, codeAssetBlocked, fmt.Errorf("host '%s' is not allowed", host))
+}
+
+// fetch returns the svg at src
+func (f *fetcher) fetch(ctx context.Context, src string) ([]byte, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, codeInvalidRequest, errors.Wrap(err, "invalid src"))
+	}
+	if err := f.check(u); err != nil {
+		return nil, err
+	}
+	key := u.String()
+
+	f.mu.Lock()
+	e := f.cache[key]
+	if e != nil {
+		e.used = time.Now()
+	}
+	f.mu.Unlock()
+	if e != nil && time.Now().Before(e.expires) {
+		return e.data, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if e != nil && e.etag != "" {
+		req.Header.Set("If-None-Match", e.etag)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		if ue, ok := err.(*url.Error); ok {
+			if ae, ok := ue.Err.(*apiError); ok {
+				return nil, ae
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, errors.Wrapf(ctx.Err(), "fetching '%s'", key)
+		}
+		return nil, newError(http.StatusBadGateway, codeFetchFailed, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && e != nil {
+		f.store(key, e.data, resp.Header)
+		return e.data, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(http.StatusBadGateway, codeFetchFailed, fmt.Errorf("fetching '%s': %s", key, resp.Status))
+	}
+	var body io.Reader = resp.Body
+	if f.maxSize > 0 {
+		body = io.LimitReader(resp.Body, f.maxSize+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, newError(http.StatusBadGateway, codeFetchFailed, errors.Wrapf(err, "fetching '%s'", key))
+	}
+	if f.maxSize > 0 && int64(len(data)) > f.maxSize {
+		return nil, &limitError{
+			status: http.StatusRequestEntityTooLarge,
+			Reason: fmt.Sprintf("'%s' is larger than %d bytes", key, f.maxSize),
+			Limit:  float64(f.maxSize),
+		}
+	}
+	// svgz files are served without a Content-Encoding
+	if data, err = decompress(data, "", f.maxSize); err != nil {
+		return nil, err
+	}
+	f.store(key, data, resp.Header)
+	return data, nil
+}
+
+// store caches data if the response headers allow it. Responses with an ETag
+// but without max-age are cached to be revalidated on every use.
+func (f *fetcher) store(key string, data []byte, h http.Header) {
+	if f.cacheSize <= 0 {
+		return
+	}
+	now := time.Now()
+	e := &cachedSVG{data: data, etag: h.Get("ETag"), expires: now, used: now}
+	noCache := false
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "no-store":
+			f.evict(key)
+			return
+		case d == "no-cache":
+			noCache = true
+		case strings.HasPrefix(d, "max-age="):
+			if secs, err := strconv.Atoi(d[len("max-age="):]); err == nil && secs > 0 {
+				e.expires = now.Add(time.Duration(secs) * time.Second)
+			}
+		}
+	}
+	if noCache {
+		e.expires = now
+	}
+	if !e.expires.After(now) && e.etag == "" {
+		f.evict(key)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.cache[key]; !ok && len(f.cache) >= f.cacheSize {
+		// evict the least recently used entry
+		var oldest string
+		for k, c := range f.cache {
+			if oldest == "" || c.used.Before(f.cache[oldest].used) {
+				oldest = k
+			}
+		}
+		delete(f.cache, oldest)
+	}
+	f.cache[key] = e
+}
+
+func (f *fetcher) evict(key string) {
+	f.mu.Lock()
+	delete(f.cache, key)
+	f.mu.Unlock()
+}
+
+// readInput returns the svg of the request: the stored svg of the id
+// parameter, fetched from the src parameter, the same from the id or src
+// field of a json body, or the body itself
+func (cfg *config) readInput(r *http.Request) ([]byte, error) {
+	src, id := r.URL.Query().Get("src"), r.URL.Query().Get("id")
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); src == "" && id == "" && ct == "application/json" {
+		body, err := cfg.limits.readBody(r)
+		if err != nil {
+			return nil, err
+		}
+		var v struct {
+			Src string `json:"src"`
+			ID  string `json:"id"`
+		}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return nil, newError(http.StatusBadRequest, codeInvalidRequest, errors.Wrap(err, "invalid json"))
+		}
+		if v.Src == "" && v.ID == "" {
+			return nil, newError(http.StatusBadRequest, codeInvalidRequest, errors.New("src or id is missing"))
+		}
+		src, id = v.Src, v.ID
+	}
+	if id != "" {
+		return cfg.storedSVG(id)
+	}
+	if src == "" {
+		return cfg.limits.readBody(r)
+	}
+	if cfg.fetcher == nil {
+		return nil, newError(http.StatusForbidden, codeAssetBlocked, errors.New("fetching svgs is disabled"))
+	}
+	return cfg.fetcher.fetch(r.Context(), src)
+}
+
+// storedSVG returns an svg of the store
+func (cfg *config) storedSVG(id string) ([]byte, error) {
+	if cfg.store == nil {
+		return nil, newError(http.StatusNotFound, codeNotFound, errors.New("the svg store is disabled"))
+	}
+	return cfg.store.Get(id)
+}
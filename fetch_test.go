@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestFetcherCheck(t *testing.T) {
+	f := NewFetcher(parseHosts("example.org, *.Example.com"), time.Second, 1, 0, 0)
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{url: "https://example.org/a.svg", ok: true},
+		{url: "http://EXAMPLE.org:8080/a.svg", ok: true},
+		{url: "https://cdn.example.com/a.svg", ok: true},
+		{url: "https://a.b.example.com/a.svg", ok: true},
+		{url: "https://example.com/a.svg"},
+		{url: "https://evil-example.com/a.svg"},
+		{url: "https://example.com.evil.org/a.svg"},
+		{url: "https://sub.example.org/a.svg"},
+		{url: "https://example.org.evil.org/a.svg"},
+		{url: "ftp://example.org/a.svg"},
+		{url: "file:///etc/passwd"},
+		{url: "//example.org/a.svg"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.check(u)
+		if tt.ok && err != nil {
+			t.Errorf("check(%s): %s", tt.url, err)
+		}
+		if !tt.ok {
+			if ae, ok := errors.Cause(err).(*apiError); !ok || ae.Code != codeAssetBlocked {
+				t.Errorf("check(%s): expected asset_blocked, got %v", tt.url, err)
+			}
+		}
+	}
+}
+
+func TestFetchRedirects(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg"/>`
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.svg":
+			w.Write([]byte(svg))
+		case "/local":
+			// same server, but under a host name that is not allowed
+			u, _ := url.Parse(srv.URL)
+			http.Redirect(w, r, "http://localhost:"+u.Port()+"/a.svg", http.StatusFound)
+		case "/scheme":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		default:
+			// /1 redirects to /a.svg, /2 to /1 and so on
+			var n int
+			fmt.Sscanf(r.URL.Path, "/%d", &n)
+			to := "/a.svg"
+			if n > 1 {
+				to = fmt.Sprintf("/%d", n-1)
+			}
+			http.Redirect(w, r, to, http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+
+	f := NewFetcher([]string{"127.0.0.1"}, time.Second, 2, 0, 0)
+	tests := []struct {
+		path string
+		code string // of the error, empty if the svg is fetched
+	}{
+		{path: "/a.svg"},
+		{path: "/1"},
+		{path: "/2"},
+		{path: "/3", code: codeFetchFailed},
+		{path: "/local", code: codeAssetBlocked},
+		{path: "/scheme", code: codeAssetBlocked},
+	}
+	for _, tt := range tests {
+		data, err := f.fetch(context.Background(), srv.URL+tt.path)
+		switch {
+		case tt.code == "" && err != nil:
+			t.Errorf("fetch(%s): %s", tt.path, err)
+		case tt.code == "" && string(data) != svg:
+			t.Errorf("fetch(%s): got %q", tt.path, data)
+		case tt.code != "" && err == nil:
+			t.Errorf("fetch(%s): expected %s", tt.path, tt.code)
+		case tt.code != "":
+			if ae := classify(err, http.StatusInternalServerError); ae.Code != tt.code {
+				t.Errorf("fetch(%s): got %s (%s), expected %s", tt.path, ae.Code, err, tt.code)
+			}
+		}
+	}
+}
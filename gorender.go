@@ -0,0 +1,1210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/image/colornames"
+	"golang.org/x/image/vector"
+)
+
+const svgNamespace = "http://www.w3.org/2000/svg"
+
+// unsupportedError is returned for svgs that use features the go renderer
+// can not draw faithfully
+type unsupportedError struct {
+	feature string
+}
+
+func (e unsupportedError) Error() string {
+	return fmt.Sprintf("the go renderer does not support %s", e.feature)
+}
+
+func unsupported(format string, args ...interface{}) error {
+	return unsupportedError{fmt.Sprintf(format, args...)}
+}
+
+// elements the go renderer draws or groups
+var goShapes = map[string]bool{
+	"path": true, "rect": true, "circle": true, "ellipse": true,
+	"line": true, "polyline": true, "polygon": true,
+}
+
+var goContainers = map[string]bool{"g": true, "a": true}
+
+// elements that are skipped together with their content. Everything in
+// them is only rendered when referenced, which is not supported anyway.
+var goSkipped = map[string]bool{
+	"title": true, "desc": true, "metadata": true, "defs": true, "symbol": true,
+}
+
+// presentation properties that can be ignored without changing the result
+// much: joins are always drawn round
+var goIgnoredProps = map[string]bool{
+	"stroke-linejoin": true, "stroke-miterlimit": true, "shape-rendering": true,
+	"color-rendering": true, "image-rendering": true, "text-rendering": true,
+	"clip-rule": true, "stroke-dashoffset": true, "color-interpolation": true,
+	"font-family": true, "font-size": true, "font-weight": true, "font-style": true,
+}
+
+// presentation attributes that change the result but are not supported
+var goUnsupportedAttrs = map[string]bool{
+	"clip-path": true, "mask": true, "filter": true, "marker": true,
+	"marker-start": true, "marker-mid": true, "marker-end": true,
+	"paint-order": true, "vector-effect": true, "mix-blend-mode": true,
+	"isolation": true,
+}
+
+type point struct{ x, y float64 }
+
+// affine is the svg matrix(a b c d e f)
+type affine [6]float64
+
+var identity = affine{1, 0, 0, 1, 0, 0}
+
+// mul returns the transform applying n first and m second
+func (m affine) mul(n affine) affine {
+	return affine{
+		m[0]*n[0] + m[2]*n[1], m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3], m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4], m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+func (m affine) apply(p point) point {
+	return point{m[0]*p.x + m[2]*p.y + m[4], m[1]*p.x + m[3]*p.y + m[5]}
+}
+
+// scale is the mean factor by which m scales lengths
+func (m affine) scale() float64 {
+	return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+var transformRE = regexp.MustCompile(`\s*([A-Za-z]+)\s*\(([^)]*)\)\s*,?`)
+
+// parseTransform parses the transform attribute
+func parseTransform(s string) (affine, error) {
+	m := identity
+	rest := strings.TrimSpace(s)
+	for rest != "" {
+		loc := transformRE.FindStringSubmatchIndex(rest)
+		if loc == nil || loc[0] != 0 {
+			return m, errors.Errorf("invalid transform '%s'", s)
+		}
+		name := rest[loc[2]:loc[3]]
+		args, err := parseNumbers(rest[loc[4]:loc[5]])
+		if err != nil {
+			return m, errors.Wrapf(err, "invalid transform '%s'", s)
+		}
+		rest = strings.TrimSpace(rest[loc[1]:])
+
+		var t affine
+		n := len(args)
+		switch {
+		case name == "matrix" && n == 6:
+			copy(t[:], args)
+		case name == "translate" && (n == 1 || n == 2):
+			t = affine{1, 0, 0, 1, args[0], 0}
+			if n == 2 {
+				t[5] = args[1]
+			}
+		case name == "scale" && (n == 1 || n == 2):
+			t = affine{args[0], 0, 0, args[0], 0, 0}
+			if n == 2 {
+				t[3] = args[1]
+			}
+		case name == "rotate" && (n == 1 || n == 3):
+			sin, cos := math.Sincos(args[0] * math.Pi / 180)
+			t = affine{cos, sin, -sin, cos, 0, 0}
+			if n == 3 {
+				t = affine{1, 0, 0, 1, args[1], args[2]}.mul(t).mul(affine{1, 0, 0, 1, -args[1], -args[2]})
+			}
+		case name == "skewX" && n == 1:
+			t = affine{1, 0, math.Tan(args[0] * math.Pi / 180), 1, 0, 0}
+		case name == "skewY" && n == 1:
+			t = affine{1, math.Tan(args[0] * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			return m, errors.Errorf("invalid transform '%s'", s)
+		}
+		m = m.mul(t)
+	}
+	return m, nil
+}
+
+// parseNumbers parses a list of numbers separated by whitespace or commas
+func parseNumbers(s string) ([]float64, error) {
+	sc := pathScanner{s: s}
+	var res []float64
+	for sc.more() {
+		v, err := sc.number()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// pathScanner tokenizes path data and number lists
+type pathScanner struct {
+	s string
+	i int
+}
+
+func (sc *pathScanner) skip() {
+	for sc.i < len(sc.s) && strings.IndexByte(" \t\r\n,", sc.s[sc.i]) >= 0 {
+		sc.i++
+	}
+}
+
+// more reports whether there is anything left after separators
+func (sc *pathScanner) more() bool {
+	sc.skip()
+	return sc.i < len(sc.s)
+}
+
+// command returns the next path command if the next token is one
+func (sc *pathScanner) command() (byte, bool) {
+	if !sc.more() {
+		return 0, false
+	}
+	c := sc.s[sc.i]
+	if (c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z') && c != 'e' && c != 'E' {
+		sc.i++
+		return c, true
+	}
+	return 0, false
+}
+
+func (sc *pathScanner) number() (float64, error) {
+	sc.skip()
+	start := sc.i
+	if sc.i < len(sc.s) && (sc.s[sc.i] == '+' || sc.s[sc.i] == '-') {
+		sc.i++
+	}
+	digits := func() int {
+		n := 0
+		for sc.i < len(sc.s) && sc.s[sc.i] >= '0' && sc.s[sc.i] <= '9' {
+			sc.i++
+			n++
+		}
+		return n
+	}
+	n := digits()
+	if sc.i < len(sc.s) && sc.s[sc.i] == '.' {
+		sc.i++
+		n += digits()
+	}
+	if n == 0 {
+		return 0, errors.Errorf("expected a number at offset %d", start)
+	}
+	if sc.i < len(sc.s) && (sc.s[sc.i] == 'e' || sc.s[sc.i] == 'E') {
+		sc.i++
+		if sc.i < len(sc.s) && (sc.s[sc.i] == '+' || sc.s[sc.i] == '-') {
+			sc.i++
+		}
+		if digits() == 0 {
+			return 0, errors.Errorf("invalid exponent at offset %d", start)
+		}
+	}
+	return strconv.ParseFloat(sc.s[start:sc.i], 64)
+}
+
+// flag reads an arc flag, which may be written without separator
+func (sc *pathScanner) flag() (bool, error) {
+	sc.skip()
+	if sc.i < len(sc.s) && (sc.s[sc.i] == '0' || sc.s[sc.i] == '1') {
+		sc.i++
+		return sc.s[sc.i-1] == '1', nil
+	}
+	return false, errors.Errorf("expected a flag at offset %d", sc.i)
+}
+
+// pathSeg is a segment of a path in user space. Quadratic curves and arcs
+// are converted to cubic ones.
+type pathSeg struct {
+	op byte // M, L, C or Z
+	p  [3]point
+}
+
+// pathBuilder keeps the state needed to resolve relative and smooth path
+// commands
+type pathBuilder struct {
+	segs       []pathSeg
+	cur, start point
+	ctrl       point // reflected control point for S and T
+	lastOp     byte
+	open       bool // a subpath has been started
+}
+
+func (b *pathBuilder) moveTo(p point) {
+	b.segs = append(b.segs, pathSeg{op: 'M', p: [3]point{p}})
+	b.cur, b.start, b.ctrl, b.open = p, p, p, true
+}
+
+// ensureOpen starts a new subpath at the current point after a close
+func (b *pathBuilder) ensureOpen() {
+	if !b.open {
+		b.moveTo(b.cur)
+	}
+}
+
+func (b *pathBuilder) lineTo(p point) {
+	b.ensureOpen()
+	b.segs = append(b.segs, pathSeg{op: 'L', p: [3]point{p}})
+	b.cur, b.ctrl = p, p
+}
+
+func (b *pathBuilder) cubeTo(c1, c2, p point) {
+	b.ensureOpen()
+	b.segs = append(b.segs, pathSeg{op: 'C', p: [3]point{c1, c2, p}})
+	b.cur, b.ctrl = p, c2
+}
+
+func (b *pathBuilder) quadTo(c, p point) {
+	p0 := b.cur
+	b.cubeTo(
+		point{p0.x + 2.0/3*(c.x-p0.x), p0.y + 2.0/3*(c.y-p0.y)},
+		point{p.x + 2.0/3*(c.x-p.x), p.y + 2.0/3*(c.y-p.y)},
+		p,
+	)
+	b.ctrl = c
+}
+
+func (b *pathBuilder) close() {
+	if b.open {
+		b.segs = append(b.segs, pathSeg{op: 'Z'})
+	}
+	b.cur, b.ctrl, b.open = b.start, b.start, false
+}
+
+// arcTo approximates an elliptical arc with cubic curves, see
+// https://www.w3.org/TR/SVG11/implnote.html#ArcImplementationNotes
+func (b *pathBuilder) arcTo(rx, ry, phi float64, large, sweep bool, p point) {
+	p0 := b.cur
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if p0 == p {
+		return
+	}
+	if rx == 0 || ry == 0 {
+		b.lineTo(p)
+		return
+	}
+	sin, cos := math.Sincos(phi * math.Pi / 180)
+	dx, dy := (p0.x-p.x)/2, (p0.y-p.y)/2
+	x1, y1 := cos*dx+sin*dy, -sin*dx+cos*dy
+	if l := x1*x1/(rx*rx) + y1*y1/(ry*ry); l > 1 {
+		rx, ry = rx*math.Sqrt(l), ry*math.Sqrt(l)
+	}
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	coef := 0.0
+	if num > 0 && den > 0 {
+		coef = math.Sqrt(num / den)
+	}
+	if large == sweep {
+		coef = -coef
+	}
+	cx1, cy1 := coef*rx*y1/ry, -coef*ry*x1/rx
+	cx, cy := cos*cx1-sin*cy1+(p0.x+p.x)/2, sin*cx1+cos*cy1+(p0.y+p.y)/2
+
+	angle := func(ux, uy, vx, vy float64) float64 {
+		return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy)
+	}
+	t1 := angle(1, 0, (x1-cx1)/rx, (y1-cy1)/ry)
+	dt := angle((x1-cx1)/rx, (y1-cy1)/ry, (-x1-cx1)/rx, (-y1-cy1)/ry)
+	if !sweep && dt > 0 {
+		dt -= 2 * math.Pi
+	} else if sweep && dt < 0 {
+		dt += 2 * math.Pi
+	}
+
+	at := func(a float64) (point, point) {
+		s, c := math.Sincos(a)
+		x, y := rx*c, ry*s
+		tx, ty := -rx*s, ry*c
+		return point{cos*x - sin*y + cx, sin*x + cos*y + cy}, point{cos*tx - sin*ty, sin*tx + cos*ty}
+	}
+	n := int(math.Ceil(math.Abs(dt) / (math.Pi / 2)))
+	step := dt / float64(n)
+	k := 4.0 / 3 * math.Tan(step/4)
+	for i := 0; i < n; i++ {
+		a1, d1 := at(t1 + step*float64(i))
+		a2, d2 := at(t1 + step*float64(i+1))
+		if i == n-1 {
+			a2 = p
+		}
+		b.cubeTo(point{a1.x + k*d1.x, a1.y + k*d1.y}, point{a2.x - k*d2.x, a2.y - k*d2.y}, a2)
+	}
+}
+
+// parsePath parses the d attribute of a path
+func parsePath(d string) ([]pathSeg, error) {
+	sc := pathScanner{s: d}
+	b := &pathBuilder{}
+	var op byte
+	for sc.more() {
+		if c, ok := sc.command(); ok {
+			op = c
+		} else if op == 0 {
+			return nil, errors.Errorf("expected a path command in '%s'", d)
+		}
+		rel := op >= 'a'
+		abs := func(x, y float64) point {
+			if rel {
+				return point{b.cur.x + x, b.cur.y + y}
+			}
+			return point{x, y}
+		}
+		nums := func(n int) ([]float64, error) {
+			v := make([]float64, n)
+			for i := range v {
+				var err error
+				if v[i], err = sc.number(); err != nil {
+					return nil, errors.Wrapf(err, "invalid path '%s'", d)
+				}
+			}
+			return v, nil
+		}
+		if op != 'M' && op != 'm' && op != 'Z' && op != 'z' && len(b.segs) == 0 {
+			return nil, errors.Errorf("path data must start with a moveto: '%s'", d)
+		}
+
+		switch op {
+		case 'Z', 'z':
+			b.close()
+			b.lastOp = op
+			op = 0
+			continue
+		case 'M', 'm':
+			v, err := nums(2)
+			if err != nil {
+				return nil, err
+			}
+			b.moveTo(abs(v[0], v[1]))
+			// further coordinate pairs are implicit linetos
+			op = 'L' + op - 'M'
+		case 'L', 'l':
+			v, err := nums(2)
+			if err != nil {
+				return nil, err
+			}
+			b.lineTo(abs(v[0], v[1]))
+		case 'H', 'h':
+			v, err := nums(1)
+			if err != nil {
+				return nil, err
+			}
+			p := point{v[0], b.cur.y}
+			if rel {
+				p.x += b.cur.x
+			}
+			b.lineTo(p)
+		case 'V', 'v':
+			v, err := nums(1)
+			if err != nil {
+				return nil, err
+			}
+			p := point{b.cur.x, v[0]}
+			if rel {
+				p.y += b.cur.y
+			}
+			b.lineTo(p)
+		case 'C', 'c':
+			v, err := nums(6)
+			if err != nil {
+				return nil, err
+			}
+			b.cubeTo(abs(v[0], v[1]), abs(v[2], v[3]), abs(v[4], v[5]))
+		case 'S', 's':
+			v, err := nums(4)
+			if err != nil {
+				return nil, err
+			}
+			c1 := b.cur
+			if strings.IndexByte("CcSs", b.lastOp) >= 0 {
+				c1 = point{2*b.cur.x - b.ctrl.x, 2*b.cur.y - b.ctrl.y}
+			}
+			b.cubeTo(c1, abs(v[0], v[1]), abs(v[2], v[3]))
+		case 'Q', 'q':
+			v, err := nums(4)
+			if err != nil {
+				return nil, err
+			}
+			b.quadTo(abs(v[0], v[1]), abs(v[2], v[3]))
+		case 'T', 't':
+			v, err := nums(2)
+			if err != nil {
+				return nil, err
+			}
+			c := b.cur
+			if strings.IndexByte("QqTt", b.lastOp) >= 0 {
+				c = point{2*b.cur.x - b.ctrl.x, 2*b.cur.y - b.ctrl.y}
+			}
+			b.quadTo(c, abs(v[0], v[1]))
+		case 'A', 'a':
+			v, err := nums(3)
+			if err != nil {
+				return nil, err
+			}
+			large, err := sc.flag()
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid path '%s'", d)
+			}
+			sweep, err := sc.flag()
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid path '%s'", d)
+			}
+			p, err := nums(2)
+			if err != nil {
+				return nil, err
+			}
+			b.arcTo(v[0], v[1], v[2], large, sweep, abs(p[0], p[1]))
+		default:
+			return nil, errors.Errorf("unknown path command '%c'", op)
+		}
+		b.lastOp = op
+	}
+	return b.segs, nil
+}
+
+// paint is a solid fill or stroke
+type paint struct {
+	c       color.NRGBA
+	none    bool
+	current bool // currentColor
+}
+
+// parsePaint parses a color, none or currentColor. Gradients and patterns
+// are not supported.
+func parsePaint(s string) (paint, error) {
+	s = strings.TrimSpace(s)
+	ls := strings.ToLower(s)
+	switch {
+	case ls == "none":
+		return paint{none: true}, nil
+	case ls == "currentcolor":
+		return paint{current: true}, nil
+	case ls == "transparent":
+		return paint{}, nil
+	case strings.HasPrefix(ls, "url("):
+		return paint{}, unsupported("paint servers like '%s'", s)
+	case strings.HasPrefix(ls, "#"):
+		hex := ls[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 6 {
+			return paint{}, errors.Errorf("invalid color '%s'", s)
+		}
+		return paint{c: color.NRGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}}, nil
+	case strings.HasPrefix(ls, "rgb(") && strings.HasSuffix(ls, ")"):
+		parts := strings.Split(ls[4:len(ls)-1], ",")
+		if len(parts) != 3 {
+			return paint{}, errors.Errorf("invalid color '%s'", s)
+		}
+		var rgb [3]uint8
+		for i, p := range parts {
+			p = strings.TrimSpace(p)
+			scale := 1.0
+			if strings.HasSuffix(p, "%") {
+				p, scale = strings.TrimSuffix(p, "%"), 2.55
+			}
+			v, err := strconv.ParseFloat(p, 64)
+			if err != nil {
+				return paint{}, errors.Errorf("invalid color '%s'", s)
+			}
+			rgb[i] = uint8(math.Max(0, math.Min(255, math.Round(v*scale))))
+		}
+		return paint{c: color.NRGBA{rgb[0], rgb[1], rgb[2], 255}}, nil
+	}
+	c, ok := colornames.Map[ls]
+	if !ok {
+		return paint{}, unsupported("the color '%s'", s)
+	}
+	return paint{c: color.NRGBA{c.R, c.G, c.B, c.A}}, nil
+}
+
+// goStyle holds the presentation properties of an element
+type goStyle struct {
+	fill, stroke               paint
+	color                      color.NRGBA
+	fillOpacity, strokeOpacity float64
+	opacity                    float64 // not inherited
+	strokeWidth                float64
+	linecap                    string
+	hidden                     bool // visibility, inherited
+	displayNone                bool // not inherited
+}
+
+func defaultStyle() goStyle {
+	return goStyle{
+		fill:          paint{c: color.NRGBA{0, 0, 0, 255}},
+		stroke:        paint{none: true},
+		color:         color.NRGBA{0, 0, 0, 255},
+		fillOpacity:   1,
+		strokeOpacity: 1,
+		opacity:       1,
+		strokeWidth:   1,
+		linecap:       "butt",
+	}
+}
+
+// set applies a single presentation property. ok is false for properties
+// the go renderer does not know.
+func (st *goStyle) set(name, value string) (ok bool, err error) {
+	value = strings.TrimSpace(value)
+	if value == "inherit" {
+		return true, nil
+	}
+	opacity := func() (float64, error) {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, errors.Errorf("invalid %s '%s'", name, value)
+		}
+		return math.Max(0, math.Min(1, v)), nil
+	}
+	switch name {
+	case "fill":
+		st.fill, err = parsePaint(value)
+	case "stroke":
+		st.stroke, err = parsePaint(value)
+	case "color":
+		var p paint
+		if p, err = parsePaint(value); err == nil && !p.none && !p.current {
+			st.color = p.c
+		}
+	case "fill-opacity":
+		st.fillOpacity, err = opacity()
+	case "stroke-opacity":
+		st.strokeOpacity, err = opacity()
+	case "opacity":
+		st.opacity, err = opacity()
+	case "stroke-width":
+		var ok bool
+		if st.strokeWidth, ok, err = parseCoord(value); err == nil && !ok {
+			st.strokeWidth = 0
+		}
+	case "stroke-linecap":
+		if value != "butt" && value != "round" && value != "square" {
+			return true, errors.Errorf("invalid stroke-linecap '%s'", value)
+		}
+		st.linecap = value
+	case "display":
+		st.displayNone = value == "none"
+	case "visibility":
+		st.hidden = value == "hidden" || value == "collapse"
+	case "fill-rule":
+		if value != "nonzero" {
+			return true, unsupported("fill-rule '%s'", value)
+		}
+	case "stroke-dasharray":
+		if value != "none" {
+			return true, unsupported("dashed strokes")
+		}
+	default:
+		return goIgnoredProps[name], nil
+	}
+	return true, err
+}
+
+// parseCoord parses a coordinate or length in user units. ok is false for
+// non-positive values.
+func parseCoord(s string) (float64, bool, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "%") {
+		return 0, false, unsupported("percentage lengths")
+	}
+	i := len(s)
+	for i > 0 && (s[i-1] >= 'a' && s[i-1] <= 'z' || s[i-1] >= 'A' && s[i-1] <= 'Z') {
+		i--
+	}
+	f, known := unitFactors[strings.ToLower(s[i:])]
+	if !known {
+		return 0, false, errors.Errorf("unsupported unit in length '%s'", s)
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, false, errors.Errorf("invalid length '%s'", s)
+	}
+	return v * f, v > 0, nil
+}
+
+// svgNode is an element of the parsed svg document
+type svgNode struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []*svgNode
+}
+
+func (n *svgNode) attr(name string) string {
+	for _, a := range n.attrs {
+		if a.Name.Local == name && a.Name.Space == "" {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// parseTree reads the element tree of an svg
+func parseTree(data []byte) (*svgNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	var stack []*svgNode
+	var root *svgNode
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse svg")
+		}
+		switch se := t.(type) {
+		case xml.StartElement:
+			n := &svgNode{name: se.Name, attrs: se.Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	if root == nil || root.name.Local != "svg" {
+		return nil, errors.New("svg root element not found")
+	}
+	return root, nil
+}
+
+// goShape is a path to be filled and stroked in device space
+type goShape struct {
+	segs []pathSeg
+	m    affine
+	st   goStyle
+}
+
+// goDrawing is an svg prepared for the go renderer
+type goDrawing struct {
+	width, height int
+	shapes        []goShape
+}
+
+// viewBoxTransform maps the viewBox to a w x h viewport according to
+// preserveAspectRatio
+func viewBoxTransform(root *svgNode, w, h float64) (affine, error) {
+	vb := strings.FieldsFunc(root.attr("viewBox"), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	if len(vb) != 4 {
+		return identity, nil
+	}
+	var v [4]float64
+	for i, f := range vb {
+		var err error
+		if v[i], err = strconv.ParseFloat(f, 64); err != nil {
+			return identity, errors.Errorf("invalid viewBox '%s'", root.attr("viewBox"))
+		}
+	}
+	if v[2] <= 0 || v[3] <= 0 {
+		return identity, nil
+	}
+	sx, sy := w/v[2], h/v[3]
+	par := strings.Fields(root.attr("preserveAspectRatio"))
+	align, slice := "xMidYMid", false
+	if len(par) > 0 {
+		align = par[0]
+	}
+	if len(par) > 1 {
+		slice = par[1] == "slice"
+	}
+	if align != "none" {
+		if slice {
+			sx = math.Max(sx, sy)
+		} else {
+			sx = math.Min(sx, sy)
+		}
+		sy = sx
+	}
+	tx, ty := -v[0]*sx, -v[1]*sy
+	switch {
+	case strings.Contains(align, "xMid"):
+		tx += (w - v[2]*sx) / 2
+	case strings.Contains(align, "xMax"):
+		tx += w - v[2]*sx
+	}
+	switch {
+	case strings.Contains(align, "YMid"):
+		ty += (h - v[3]*sy) / 2
+	case strings.Contains(align, "YMax"):
+		ty += h - v[3]*sy
+	}
+	return affine{sx, 0, 0, sy, tx, ty}, nil
+}
+
+// newGoDrawing prepares the svg for the go renderer at the size and scale
+// of the shot. An unsupportedError is returned if the svg or the shot use
+// anything the go renderer can not draw. Attribute values it can not parse
+// are unsupported as well, chrome may still render them.
+func newGoDrawing(svg []byte, size svgSize, s shot) (*goDrawing, error) {
+	d, err := prepareGoDrawing(svg, size, s)
+	if err == nil {
+		return d, nil
+	}
+	switch errors.Cause(err).(type) {
+	case unsupportedError, *apiError, *limitError:
+		return nil, err
+	}
+	return nil, newError(http.StatusUnprocessableEntity, codeUnsupported, err)
+}
+
+// prepareGoDrawing parses the svg and collects its shapes
+func prepareGoDrawing(svg []byte, size svgSize, s shot) (*goDrawing, error) {
+	for _, p := range []string{"el", "t", "bbox"} {
+		if s.params.Get(p) != "" {
+			return nil, unsupported("element, time or trim=bbox")
+		}
+	}
+	root, err := parseTree(svg)
+	if err != nil {
+		return nil, newError(http.StatusBadRequest, codeInvalidSVG, err)
+	}
+	scale := s.scaleFor(size.Width, size.Height)
+	d := &goDrawing{
+		width:  int(math.Ceil(size.Width * scale)),
+		height: int(math.Ceil(size.Height * scale)),
+	}
+	if root.attr("transform") != "" {
+		return nil, unsupported("transforms on the root element")
+	}
+	m, err := viewBoxTransform(root, size.Width, size.Height)
+	if err != nil {
+		return nil, err
+	}
+	m = affine{scale, 0, 0, scale, 0, 0}.mul(m)
+	if err := d.add(root, defaultStyle(), m, true); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// add collects the shapes of n and its children
+func (d *goDrawing) add(n *svgNode, parent goStyle, m affine, root bool) error {
+	if n.name.Space != "" && n.name.Space != svgNamespace {
+		return nil // foreign elements like editor metadata
+	}
+	name := n.name.Local
+	switch {
+	case goSkipped[name]:
+		return nil
+	case name == "style":
+		return unsupported("style sheets")
+	case name == "svg" && !root:
+		return unsupported("nested svg elements")
+	case !goShapes[name] && !goContainers[name] && !root:
+		return unsupported("<%s> elements", name)
+	}
+
+	st := parent
+	st.opacity, st.displayNone = 1, false
+	for _, a := range n.attrs {
+		if a.Name.Space != "" {
+			continue
+		}
+		ok, err := st.set(a.Name.Local, a.Value)
+		if err != nil {
+			return err
+		}
+		if !ok && goUnsupportedAttrs[a.Name.Local] {
+			return unsupported("the %s attribute", a.Name.Local)
+		}
+	}
+	if style := n.attr("style"); style != "" {
+		for _, decl := range strings.Split(style, ";") {
+			parts := strings.SplitN(decl, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			prop := strings.ToLower(strings.TrimSpace(parts[0]))
+			ok, err := st.set(prop, parts[1])
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return unsupported("the style property '%s'", prop)
+			}
+		}
+	}
+	if st.displayNone {
+		return nil
+	}
+	if t := n.attr("transform"); t != "" && !root {
+		tm, err := parseTransform(t)
+		if err != nil {
+			return err
+		}
+		m = m.mul(tm)
+	}
+
+	if !goShapes[name] {
+		if st.opacity != 1 {
+			return unsupported("group opacity")
+		}
+		for _, c := range n.children {
+			if err := d.add(c, st, m, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if st.hidden {
+		return nil
+	}
+	for _, c := range n.children {
+		if c.name.Space == svgNamespace || c.name.Space == "" {
+			if !goSkipped[c.name.Local] {
+				return unsupported("<%s> inside <%s>", c.name.Local, name)
+			}
+		}
+	}
+	segs, err := shapePath(n)
+	if err != nil {
+		return err
+	}
+	if st.fill.current {
+		st.fill = paint{c: st.color}
+	}
+	if st.stroke.current {
+		st.stroke = paint{c: st.color}
+	}
+	d.shapes = append(d.shapes, goShape{segs: segs, m: m, st: st})
+	return nil
+}
+
+// shapePath converts a basic shape to path segments
+func shapePath(n *svgNode) ([]pathSeg, error) {
+	var coordErr error
+	coord := func(name string) float64 {
+		s := n.attr(name)
+		if s == "" {
+			return 0
+		}
+		v, _, err := parseCoord(s)
+		if err != nil && coordErr == nil {
+			coordErr = err
+		}
+		return v
+	}
+	b := &pathBuilder{}
+	switch n.name.Local {
+	case "path":
+		return parsePath(n.attr("d"))
+	case "rect":
+		x, y, w, h := coord("x"), coord("y"), coord("width"), coord("height")
+		rx, ry := coord("rx"), coord("ry")
+		if coordErr != nil || w <= 0 || h <= 0 {
+			return nil, coordErr
+		}
+		if n.attr("rx") == "" {
+			rx = ry
+		}
+		if n.attr("ry") == "" {
+			ry = rx
+		}
+		rx, ry = math.Min(math.Max(rx, 0), w/2), math.Min(math.Max(ry, 0), h/2)
+		if rx == 0 || ry == 0 {
+			b.moveTo(point{x, y})
+			b.lineTo(point{x + w, y})
+			b.lineTo(point{x + w, y + h})
+			b.lineTo(point{x, y + h})
+			b.close()
+			return b.segs, nil
+		}
+		b.moveTo(point{x + rx, y})
+		b.lineTo(point{x + w - rx, y})
+		b.arcTo(rx, ry, 0, false, true, point{x + w, y + ry})
+		b.lineTo(point{x + w, y + h - ry})
+		b.arcTo(rx, ry, 0, false, true, point{x + w - rx, y + h})
+		b.lineTo(point{x + rx, y + h})
+		b.arcTo(rx, ry, 0, false, true, point{x, y + h - ry})
+		b.lineTo(point{x, y + ry})
+		b.arcTo(rx, ry, 0, false, true, point{x + rx, y})
+		b.close()
+	case "circle", "ellipse":
+		cx, cy := coord("cx"), coord("cy")
+		rx, ry := coord("rx"), coord("ry")
+		if n.name.Local == "circle" {
+			rx = coord("r")
+			ry = rx
+		}
+		if coordErr != nil || rx <= 0 || ry <= 0 {
+			return nil, coordErr
+		}
+		b.moveTo(point{cx + rx, cy})
+		b.arcTo(rx, ry, 0, false, true, point{cx - rx, cy})
+		b.arcTo(rx, ry, 0, false, true, point{cx + rx, cy})
+		b.close()
+	case "line":
+		b.moveTo(point{coord("x1"), coord("y1")})
+		b.lineTo(point{coord("x2"), coord("y2")})
+	case "polyline", "polygon":
+		v, err := parseNumbers(n.attr("points"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid points")
+		}
+		for i := 0; i+1 < len(v); i += 2 {
+			if i == 0 {
+				b.moveTo(point{v[0], v[1]})
+			} else {
+				b.lineTo(point{v[i], v[i+1]})
+			}
+		}
+		if n.name.Local == "polygon" && len(v) >= 2 {
+			b.close()
+		}
+	}
+	return b.segs, coordErr
+}
+
+// polyline is a flattened subpath in device space
+type polyline struct {
+	pts    []point
+	closed bool
+}
+
+// flatten transforms the segments to device space and approximates curves
+// with lines
+func flatten(segs []pathSeg, m affine) []polyline {
+	var res []polyline
+	for _, s := range segs {
+		switch s.op {
+		case 'M':
+			res = append(res, polyline{pts: []point{m.apply(s.p[0])}})
+		case 'L':
+			pl := &res[len(res)-1]
+			pl.pts = append(pl.pts, m.apply(s.p[0]))
+		case 'C':
+			pl := &res[len(res)-1]
+			p0 := pl.pts[len(pl.pts)-1]
+			p1, p2, p3 := m.apply(s.p[0]), m.apply(s.p[1]), m.apply(s.p[2])
+			l := math.Hypot(p1.x-p0.x, p1.y-p0.y) + math.Hypot(p2.x-p1.x, p2.y-p1.y) + math.Hypot(p3.x-p2.x, p3.y-p2.y)
+			n := int(math.Min(256, math.Max(1, math.Ceil(math.Sqrt(l)*2))))
+			for i := 1; i <= n; i++ {
+				t := float64(i) / float64(n)
+				u := 1 - t
+				a, b, c, d := u*u*u, 3*u*u*t, 3*u*t*t, t*t*t
+				pl.pts = append(pl.pts, point{
+					a*p0.x + b*p1.x + c*p2.x + d*p3.x,
+					a*p0.y + b*p1.y + c*p2.y + d*p3.y,
+				})
+			}
+		case 'Z':
+			res[len(res)-1].closed = true
+		}
+	}
+	return res
+}
+
+// addPolygon adds a closed polygon to z. All polygons are added in the same
+// orientation so that overlapping ones add up instead of cancelling out.
+func addPolygon(z *vector.Rasterizer, pts []point) {
+	area := 0.0
+	for i, p := range pts {
+		q := pts[(i+1)%len(pts)]
+		area += p.x*q.y - q.x*p.y
+	}
+	for i := range pts {
+		p := pts[i]
+		if area > 0 {
+			p = pts[len(pts)-1-i]
+		}
+		if i == 0 {
+			z.MoveTo(float32(p.x), float32(p.y))
+		} else {
+			z.LineTo(float32(p.x), float32(p.y))
+		}
+	}
+	z.ClosePath()
+}
+
+func addCircle(z *vector.Rasterizer, c point, r float64) {
+	n := int(math.Min(64, math.Max(8, math.Ceil(r*2))))
+	pts := make([]point, n)
+	for i := range pts {
+		s, cos := math.Sincos(2 * math.Pi * float64(i) / float64(n))
+		pts[i] = point{c.x + r*cos, c.y + r*s}
+	}
+	addPolygon(z, pts)
+}
+
+// addSegment adds the rectangle covering the line from p to q with a half
+// width of hw
+func addSegment(z *vector.Rasterizer, p, q point, hw float64) {
+	l := math.Hypot(q.x-p.x, q.y-p.y)
+	if l == 0 {
+		return
+	}
+	nx, ny := -(q.y-p.y)/l*hw, (q.x-p.x)/l*hw
+	addPolygon(z, []point{{p.x + nx, p.y + ny}, {q.x + nx, q.y + ny}, {q.x - nx, q.y - ny}, {p.x - nx, p.y - ny}})
+}
+
+// addStroke adds the outline of a stroked polyline to z. Joins are always
+// round.
+func addStroke(z *vector.Rasterizer, pl polyline, hw float64, linecap string) {
+	var pts []point
+	for _, p := range pl.pts {
+		if len(pts) == 0 || p != pts[len(pts)-1] {
+			pts = append(pts, p)
+		}
+	}
+	if len(pts) == 0 {
+		return
+	}
+	if len(pts) == 1 {
+		switch linecap {
+		case "round":
+			addCircle(z, pts[0], hw)
+		case "square":
+			p := pts[0]
+			addPolygon(z, []point{{p.x - hw, p.y - hw}, {p.x + hw, p.y - hw}, {p.x + hw, p.y + hw}, {p.x - hw, p.y + hw}})
+		}
+		return
+	}
+	if pl.closed && pts[0] != pts[len(pts)-1] {
+		pts = append(pts, pts[0])
+	}
+	for i := 0; i+1 < len(pts); i++ {
+		addSegment(z, pts[i], pts[i+1], hw)
+		if i > 0 || pl.closed {
+			addCircle(z, pts[i], hw)
+		}
+	}
+	if pl.closed {
+		return
+	}
+	first, last := pts[0], pts[len(pts)-1]
+	switch linecap {
+	case "round":
+		addCircle(z, first, hw)
+		addCircle(z, last, hw)
+	case "square":
+		for _, e := range [][2]point{{first, pts[1]}, {last, pts[len(pts)-2]}} {
+			l := math.Hypot(e[0].x-e[1].x, e[0].y-e[1].y)
+			ext := point{e[0].x + (e[0].x-e[1].x)/l*hw, e[0].y + (e[0].y-e[1].y)/l*hw}
+			addSegment(z, e[0], ext, hw)
+		}
+	}
+}
+
+// withAlpha returns c with its alpha multiplied by a
+func withAlpha(c color.NRGBA, a float64) *image.Uniform {
+	c.A = uint8(math.Round(float64(c.A) * a))
+	return image.NewUniform(c)
+}
+
+// clipRect returns the pixels of the canvas covered by the polylines grown
+// by margin on every side
+func (d *goDrawing) clipRect(lines []polyline, margin float64) image.Rectangle {
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, pl := range lines {
+		for _, p := range pl.pts {
+			minX, minY = math.Min(minX, p.x), math.Min(minY, p.y)
+			maxX, maxY = math.Max(maxX, p.x), math.Max(maxY, p.y)
+		}
+	}
+	if minX > maxX {
+		return image.Rectangle{}
+	}
+	// clamp before converting, the points may lie far outside the canvas
+	clamp := func(v float64, max int) int {
+		return int(math.Max(0, math.Min(float64(max), v)))
+	}
+	return image.Rect(
+		clamp(math.Floor(minX-margin), d.width), clamp(math.Floor(minY-margin), d.height),
+		clamp(math.Ceil(maxX+margin), d.width), clamp(math.Ceil(maxY+margin), d.height),
+	)
+}
+
+// shift moves the polylines by -o
+func shift(lines []polyline, o image.Point) []polyline {
+	res := make([]polyline, len(lines))
+	for i, pl := range lines {
+		pts := make([]point, len(pl.pts))
+		for j, p := range pl.pts {
+			pts[j] = point{p.x - float64(o.X), p.y - float64(o.Y)}
+		}
+		res[i] = polyline{pts: pts, closed: pl.closed}
+	}
+	return res
+}
+
+// image draws the shapes in document order. Each shape is only rasterized
+// within its bounding box. ctx is checked between shapes.
+func (d *goDrawing) image(ctx context.Context) (*image.RGBA, error) {
+	dst := image.NewRGBA(image.Rect(0, 0, d.width, d.height))
+	z := &vector.Rasterizer{}
+	for _, s := range d.shapes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		lines := flatten(s.segs, s.m)
+		if r := d.clipRect(lines, 1); !s.st.fill.none && !r.Empty() {
+			z.Reset(r.Dx(), r.Dy())
+			for _, pl := range shift(lines, r.Min) {
+				if len(pl.pts) < 3 {
+					continue
+				}
+				z.MoveTo(float32(pl.pts[0].x), float32(pl.pts[0].y))
+				for _, p := range pl.pts[1:] {
+					z.LineTo(float32(p.x), float32(p.y))
+				}
+				z.ClosePath()
+			}
+			z.Draw(dst, r, withAlpha(s.st.fill.c, s.st.fillOpacity*s.st.opacity), image.Point{})
+		}
+		if hw := s.st.strokeWidth * s.m.scale() / 2; !s.st.stroke.none && hw > 0 {
+			// square caps reach furthest, diagonally
+			r := d.clipRect(lines, hw*math.Sqrt2+1)
+			if r.Empty() {
+				continue
+			}
+			z.Reset(r.Dx(), r.Dy())
+			for _, pl := range shift(lines, r.Min) {
+				addStroke(z, pl, hw, s.st.linecap)
+			}
+			z.Draw(dst, r, withAlpha(s.st.stroke.c, s.st.strokeOpacity*s.st.opacity), image.Point{})
+		}
+	}
+	return dst, nil
+}
+
+// png renders the drawing as png
+func (d *goDrawing) png(ctx context.Context) ([]byte, error) {
+	img, err := d.image(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
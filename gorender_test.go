@@ -0,0 +1,277 @@
+package main
+
+import (
+	"image/color"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func nearPoint(p, q point) bool {
+	return near(p.x, q.x) && near(p.y, q.y)
+}
+
+func nearAffine(m, n affine) bool {
+	for i := range m {
+		if !near(m[i], n[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		d    string
+		ops  string
+		last point // end point of the last segment that has one
+		err  bool
+	}{
+		{d: "", ops: ""},
+		{d: "M10 20L30 40", ops: "ML", last: point{30, 40}},
+		{d: "m10,20 l5-5", ops: "ML", last: point{15, 15}},
+		{d: "M0 0 10 10 20 0", ops: "MLL", last: point{20, 0}},
+		{d: "M0 0H10V20h-5v-5Z", ops: "MLLLLZ", last: point{5, 15}},
+		{d: "M0 0C1 1 2 2 3 3S5 5 6 6", ops: "MCC", last: point{6, 6}},
+		{d: "M0 0Q5 5 10 0T20 0", ops: "MCC", last: point{20, 0}},
+		{d: "M0 0A5 5 0 0 1 10 0", ops: "MCC", last: point{10, 0}},
+		{d: "M0 0a5 5 0 1110 0", ops: "MCC", last: point{10, 0}},
+		{d: "M0 0Z L10 10", ops: "MZML", last: point{10, 10}},
+		{d: "M.5.5l1e1-1e1", ops: "ML", last: point{10.5, -9.5}},
+		{d: "10 10", err: true},
+		{d: "M0 0L10", err: true},
+		{d: "M0 0A5 5 0 2 1 10 0", err: true},
+		{d: "M0 0X10 10", err: true},
+	}
+	for _, tt := range tests {
+		segs, err := parsePath(tt.d)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parsePath(%q): expected an error", tt.d)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePath(%q): %s", tt.d, err)
+			continue
+		}
+		ops := ""
+		var last point
+		for _, s := range segs {
+			ops += string(s.op)
+			switch s.op {
+			case 'M', 'L':
+				last = s.p[0]
+			case 'C':
+				last = s.p[2]
+			}
+		}
+		if ops != tt.ops {
+			t.Errorf("parsePath(%q): got ops %q, expected %q", tt.d, ops, tt.ops)
+		}
+		if !nearPoint(last, tt.last) {
+			t.Errorf("parsePath(%q): ends at %v, expected %v", tt.d, last, tt.last)
+		}
+	}
+}
+
+func TestArcTo(t *testing.T) {
+	tests := []struct {
+		name         string
+		rx, ry, phi  float64
+		large, sweep bool
+		to           point
+		curves       int
+		mid          point // a point the arc has to pass through
+	}{
+		{name: "same point", rx: 5, ry: 5, to: point{0, 0}},
+		{name: "zero radius", rx: 0, ry: 5, to: point{10, 0}},
+		{name: "half circle", rx: 5, ry: 5, sweep: true, to: point{10, 0}, curves: 2, mid: point{5, -5}},
+		{name: "half circle ccw", rx: 5, ry: 5, to: point{10, 0}, curves: 2, mid: point{5, 5}},
+		{name: "radius too small", rx: 1, ry: 1, sweep: true, to: point{10, 0}, curves: 2, mid: point{5, -5}},
+		{name: "quarter", rx: 10, ry: 10, sweep: true, to: point{10, 10}, curves: 1},
+		{name: "three quarters", rx: 10, ry: 10, large: true, sweep: true, to: point{10, 10}, curves: 3},
+		{name: "rotated ellipse", rx: 10, ry: 5, phi: 90, sweep: true, to: point{0, 20}, curves: 2, mid: point{5, 10}},
+	}
+	for _, tt := range tests {
+		b := &pathBuilder{}
+		b.moveTo(point{0, 0})
+		b.arcTo(tt.rx, tt.ry, tt.phi, tt.large, tt.sweep, tt.to)
+		segs := b.segs[1:]
+		if tt.curves == 0 {
+			switch {
+			case tt.to == (point{}) && len(segs) != 0:
+				t.Errorf("%s: expected no segments, got %v", tt.name, segs)
+			case tt.to != (point{}) && (len(segs) != 1 || segs[0].op != 'L' || segs[0].p[0] != tt.to):
+				t.Errorf("%s: expected a line to %v, got %v", tt.name, tt.to, segs)
+			}
+			continue
+		}
+		if len(segs) != tt.curves {
+			t.Errorf("%s: got %d curves, expected %d", tt.name, len(segs), tt.curves)
+			continue
+		}
+		for _, s := range segs {
+			if s.op != 'C' {
+				t.Errorf("%s: got op %c, expected C", tt.name, s.op)
+			}
+		}
+		if end := segs[len(segs)-1].p[2]; end != tt.to {
+			t.Errorf("%s: ends at %v, expected %v", tt.name, end, tt.to)
+		}
+		if tt.mid != (point{}) && !nearPoint(segs[0].p[2], tt.mid) {
+			t.Errorf("%s: passes through %v, expected %v", tt.name, segs[0].p[2], tt.mid)
+		}
+	}
+}
+
+func TestParseTransform(t *testing.T) {
+	tests := []struct {
+		s   string
+		m   affine
+		err bool
+	}{
+		{s: "", m: identity},
+		{s: "translate(10)", m: affine{1, 0, 0, 1, 10, 0}},
+		{s: "translate(10, 20)", m: affine{1, 0, 0, 1, 10, 20}},
+		{s: "scale(2)", m: affine{2, 0, 0, 2, 0, 0}},
+		{s: "scale(2 3)", m: affine{2, 0, 0, 3, 0, 0}},
+		{s: "rotate(90)", m: affine{0, 1, -1, 0, 0, 0}},
+		{s: "rotate(90 10 10)", m: affine{0, 1, -1, 0, 20, 0}},
+		{s: "skewX(45)", m: affine{1, 0, 1, 1, 0, 0}},
+		{s: "skewY(45)", m: affine{1, 1, 0, 1, 0, 0}},
+		{s: "matrix(1 2 3 4 5 6)", m: affine{1, 2, 3, 4, 5, 6}},
+		{s: "translate(10 20) scale(2)", m: affine{2, 0, 0, 2, 10, 20}},
+		{s: "scale(2),translate(10 20)", m: affine{2, 0, 0, 2, 20, 40}},
+		{s: "rotate(1 2)", err: true},
+		{s: "matrix(1 2 3)", err: true},
+		{s: "translate(a)", err: true},
+		{s: "perspective(1)", err: true},
+		{s: "scale(2) junk", err: true},
+	}
+	for _, tt := range tests {
+		m, err := parseTransform(tt.s)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseTransform(%q): expected an error", tt.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTransform(%q): %s", tt.s, err)
+			continue
+		}
+		if !nearAffine(m, tt.m) {
+			t.Errorf("parseTransform(%q): got %v, expected %v", tt.s, m, tt.m)
+		}
+	}
+}
+
+func TestViewBoxTransform(t *testing.T) {
+	tests := []struct {
+		attrs string
+		w, h  float64
+		m     affine
+		err   bool
+	}{
+		{attrs: ``, w: 100, h: 100, m: identity},
+		{attrs: `viewBox="0 0 0 10"`, w: 100, h: 100, m: identity},
+		{attrs: `viewBox="0 0 10 10"`, w: 100, h: 100, m: affine{10, 0, 0, 10, 0, 0}},
+		{attrs: `viewBox="5,5,10,10"`, w: 100, h: 100, m: affine{10, 0, 0, 10, -50, -50}},
+		{attrs: `viewBox="0 0 10 10"`, w: 200, h: 100, m: affine{10, 0, 0, 10, 50, 0}},
+		{attrs: `viewBox="0 0 10 10" preserveAspectRatio="xMinYMin"`, w: 200, h: 100, m: affine{10, 0, 0, 10, 0, 0}},
+		{attrs: `viewBox="0 0 10 10" preserveAspectRatio="xMaxYMax"`, w: 200, h: 100, m: affine{10, 0, 0, 10, 100, 0}},
+		{attrs: `viewBox="0 0 10 10" preserveAspectRatio="xMidYMid slice"`, w: 200, h: 100, m: affine{20, 0, 0, 20, 0, -50}},
+		{attrs: `viewBox="0 0 10 10" preserveAspectRatio="none"`, w: 200, h: 100, m: affine{20, 0, 0, 10, 0, 0}},
+		{attrs: `viewBox="0 0 ten 10"`, w: 100, h: 100, err: true},
+	}
+	for _, tt := range tests {
+		root, err := parseTree([]byte(`<svg xmlns="http://www.w3.org/2000/svg" ` + tt.attrs + `/>`))
+		if err != nil {
+			t.Fatalf("parseTree(%q): %s", tt.attrs, err)
+		}
+		m, err := viewBoxTransform(root, tt.w, tt.h)
+		if tt.err {
+			if err == nil {
+				t.Errorf("viewBoxTransform(%q): expected an error", tt.attrs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("viewBoxTransform(%q): %s", tt.attrs, err)
+			continue
+		}
+		if !nearAffine(m, tt.m) {
+			t.Errorf("viewBoxTransform(%q, %g, %g): got %v, expected %v", tt.attrs, tt.w, tt.h, m, tt.m)
+		}
+	}
+}
+
+func TestParsePaint(t *testing.T) {
+	tests := []struct {
+		s           string
+		p           paint
+		unsupported bool
+		err         bool
+	}{
+		{s: "none", p: paint{none: true}},
+		{s: "currentColor", p: paint{current: true}},
+		{s: "transparent", p: paint{}},
+		{s: "#f00", p: paint{c: color.NRGBA{255, 0, 0, 255}}},
+		{s: " #00FF7f ", p: paint{c: color.NRGBA{0, 255, 127, 255}}},
+		{s: "rgb(1, 2, 3)", p: paint{c: color.NRGBA{1, 2, 3, 255}}},
+		{s: "rgb(100%, 20%, 300)", p: paint{c: color.NRGBA{255, 51, 255, 255}}},
+		{s: "red", p: paint{c: color.NRGBA{255, 0, 0, 255}}},
+		{s: "RebeccaPurple", unsupported: true},
+		{s: "url(#gradient)", unsupported: true},
+		{s: "#ff000080", err: true},
+		{s: "#ggg", err: true},
+		{s: "rgb(1, 2)", err: true},
+		{s: "rgb(a, b, c)", err: true},
+	}
+	for _, tt := range tests {
+		p, err := parsePaint(tt.s)
+		_, unsupported := errors.Cause(err).(unsupportedError)
+		switch {
+		case tt.unsupported:
+			if !unsupported {
+				t.Errorf("parsePaint(%q): expected an unsupportedError, got %v", tt.s, err)
+			}
+		case tt.err:
+			if err == nil || unsupported {
+				t.Errorf("parsePaint(%q): expected a parse error, got %v", tt.s, err)
+			}
+		case err != nil:
+			t.Errorf("parsePaint(%q): %s", tt.s, err)
+		case p != tt.p:
+			t.Errorf("parsePaint(%q): got %+v, expected %+v", tt.s, p, tt.p)
+		}
+	}
+}
+
+func TestNewGoDrawingErrors(t *testing.T) {
+	tests := []struct {
+		svg  string
+		code string
+	}{
+		{svg: `<svg xmlns="http://www.w3.org/2000/svg"><rect width="1" height="1" fill="#ff000080"/></svg>`, code: codeUnsupported},
+		{svg: `<svg xmlns="http://www.w3.org/2000/svg"><path d="M0 0L1"/></svg>`, code: codeUnsupported},
+		{svg: `<svg xmlns="http://www.w3.org/2000/svg"><rect`, code: codeInvalidSVG},
+	}
+	for _, tt := range tests {
+		_, err := newGoDrawing([]byte(tt.svg), svgSize{Width: 10, Height: 10}, shot{})
+		if err == nil {
+			t.Errorf("newGoDrawing(%q): expected an error", tt.svg)
+			continue
+		}
+		if ae := classify(err, http.StatusInternalServerError); ae.Code != tt.code {
+			t.Errorf("newGoDrawing(%q): got %s (%d), expected %s", tt.svg, ae.Code, ae.status, tt.code)
+		}
+	}
+}
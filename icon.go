@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/disintegration/imaging"
+)
+
+// favicon and app icon sizes used by /v1/ico if no sizes are requested
+var defaultIcoSizes = []int{16, 32, 48}
+
+// upper bound of sizes rendered for a single request
+const maxSizes = 20
+
+// parseSizes parses a csv list of square icon sizes in pixels
+func parseSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid size '%s'", f)
+		}
+		sizes = append(sizes, n)
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no sizes in '%s'", s)
+	}
+	if len(sizes) > maxSizes {
+		return nil, fmt.Errorf("%d sizes requested, at most %d are allowed", len(sizes), maxSizes)
+	}
+	return sizes, nil
+}
+
+// squareIcon centers a rendered png on a transparent n x n canvas
+func squareIcon(data []byte, n int) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	if b.Dx() == n && b.Dy() == n {
+		return data, nil
+	}
+	if b.Dx() > n || b.Dy() > n {
+		img = imaging.Fit(img, n, n, imaging.Lanczos)
+	}
+	square := imaging.PasteCenter(imaging.New(n, n, color.Transparent), img)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, square); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderIcons renders the svg once per size as square png, with the
+// watermark applied if not nil
+func renderIcons(r *http.Request, rd *renderer, body []byte, size svgSize, params url.Values, sizes []int, wm *watermark) ([][]byte, error) {
+	shots := make([]shot, len(sizes))
+	for i, n := range sizes {
+		shots[i] = shot{params: params, fit: float64(n)}
+	}
+	res, err := rd.render(r.Context(), body, size, shots...)
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range sizes {
+		if res[i], err = squareIcon(res[i], n); err != nil {
+			return nil, err
+		}
+		if res[i], err = postProcess(res[i], postOptions{watermark: wm}); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// checkIcoSizes makes sure all sizes can be represented in an ico
+func checkIcoSizes(sizes []int) error {
+	for _, n := range sizes {
+		if n > 256 {
+			return fmt.Errorf("ico images can not be larger than 256px, got %d", n)
+		}
+	}
+	return nil
+}
+
+// encodeICO packs png images into a windows .ico container, see checkIcoSizes
+func encodeICO(sizes []int, pngs [][]byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, [3]uint16{0, 1, uint16(len(pngs))})
+	offset := 6 + 16*len(pngs)
+	for i, n := range sizes {
+		dim := uint8(n)
+		if n == 256 {
+			dim = 0
+		}
+		binary.Write(&buf, binary.LittleEndian, struct {
+			Width, Height, Colors, Reserved uint8
+			Planes, BitCount                uint16
+			Size, Offset                    uint32
+		}{dim, dim, 0, 0, 1, 32, uint32(len(pngs[i])), uint32(offset)})
+		offset += len(pngs[i])
+	}
+	for _, p := range pngs {
+		buf.Write(p)
+	}
+	return buf.Bytes()
+}
+
+// icoHandler renders the svg at all requested sizes and packs them into
+// a favicon
+func icoHandler(rd *renderer, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, size, s, status, err := readSVG(r, cfg)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, status)
+			return
+		}
+		sizes := defaultIcoSizes
+		if v := r.URL.Query().Get("sizes"); v != "" {
+			if sizes, err = parseSizes(v); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusBadRequest)
+				return
+			}
+		}
+		err = checkIcoSizes(sizes)
+		if err == nil {
+			err = cfg.checkSizes(r, sizes)
+		}
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		post, err := cfg.postOptions(r, size, s)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		res, err := renderIcons(r, rd, body, size, s.params, sizes, post.watermark)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/x-icon")
+		w.Write(encodeICO(sizes, res))
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// maximum number of outputs of a single /v2/render request
+const maxOutputs = 10
+
+// renderRequest is the body of /v2/render. options and the options of each
+// output take the query parameters of the v1 endpoints.
+type renderRequest struct {
+	SVG     string                 `json:"svg"` // svg text, base64 or a data uri
+	Src     string                 `json:"src"` // fetched if svg is empty
+	ID      string                 `json:"id"`  // of the svg store
+	Options map[string]interface{} `json:"options"`
+	Outputs []outputRequest        `json:"outputs"` // a single png if empty
+}
+
+type outputRequest struct {
+	Format  string                 `json:"format"` // png (default), tiff, bmp or pdf
+	Options map[string]interface{} `json:"options"`
+}
+
+type renderOutput struct {
+	Format      string `json:"format"`
+	ContentType string `json:"content_type"`
+	Renderer    string `json:"renderer"`
+	Data        string `json:"data"` // base64
+}
+
+type renderResponse struct {
+	Width   float64        `json:"width"`
+	Height  float64        `json:"height"`
+	Outputs []renderOutput `json:"outputs"`
+}
+
+// decodeSVGInput returns the svg of the svg field
+func decodeSVGInput(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "<"):
+		return []byte(s), nil
+	case strings.HasPrefix(s, "data:"):
+		i := strings.IndexByte(s, ',')
+		if i < 0 {
+			return nil, errors.New("invalid data uri")
+		}
+		if strings.HasSuffix(s[:i], ";base64") {
+			return base64.StdEncoding.DecodeString(s[i+1:])
+		}
+		data, err := url.PathUnescape(s[i+1:])
+		return []byte(data), err
+	default:
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, errors.New("svg is neither svg text, base64 nor a data uri")
+		}
+		return data, nil
+	}
+}
+
+// optionValues converts json options to query parameters
+func optionValues(q url.Values, options map[string]interface{}) error {
+	for k, v := range options {
+		switch v := v.(type) {
+		case string:
+			q.Set(k, v)
+		case float64:
+			q.Set(k, strconv.FormatFloat(v, 'g', -1, 64))
+		case bool:
+			q.Set(k, strconv.FormatBool(v))
+		default:
+			return fmt.Errorf("option '%s' must be a string, number or boolean", k)
+		}
+	}
+	return nil
+}
+
+// renderOne renders a single output of a /v2/render request. total are the
+// pixels of the outputs so far, the output is added before it is rendered. On
+// error the status to respond with is returned.
+func renderOne(r *http.Request, rd *renderer, cfg *config, svg []byte, format string, q url.Values, total *float64) (renderOutput, int, error) {
+	out := renderOutput{Format: format, Renderer: chromeRenderer}
+	if !keyAllows(r, format) {
+		return out, http.StatusForbidden, newError(http.StatusForbidden, codeForbidden, fmt.Errorf("format '%s' is not allowed for this api key", format))
+	}
+	size, s, err := keySVGParams(r, svg, q, cfg)
+	if err != nil {
+		return out, http.StatusBadRequest, err
+	}
+	if format == "pdf" {
+		// pdfs are vector output, a watermark can not be composited into them
+		if cfg.enforcedWatermark(requestKey(r)) != "" {
+			return out, http.StatusForbidden, newError(http.StatusForbidden, codeForbidden, errors.New("pdf output is not allowed for api keys with an enforced watermark"))
+		}
+		w, h := s.imageSize(size)
+		*total += w * h
+		if err := cfg.checkTotal(r, *total); err != nil {
+			return out, http.StatusUnprocessableEntity, err
+		}
+		out.ContentType = "application/pdf"
+		data, err := rd.renderPDF(r.Context(), svg, size, s)
+		if err != nil {
+			return out, http.StatusInternalServerError, err
+		}
+		out.Data = base64.StdEncoding.EncodeToString(data)
+		return out, http.StatusOK, nil
+	}
+
+	f, ok := rasterFormats[format]
+	if !ok && format != "png" {
+		return out, http.StatusBadRequest, fmt.Errorf("unsupported format '%s', expected png, tiff, bmp or pdf", format)
+	}
+	if format == "tiff" {
+		if _, err := parseTIFFCompression(q); err != nil {
+			return out, http.StatusBadRequest, err
+		}
+	}
+	post, err := cfg.queryPostOptions(q, r, size, s)
+	if err != nil {
+		return out, http.StatusBadRequest, err
+	}
+	w, h := post.outputSize(s.imageSize(size))
+	*total += w * h
+	if err := cfg.checkTotal(r, *total); err != nil {
+		return out, http.StatusUnprocessableEntity, err
+	}
+	mode, err := parseRendererMode(q)
+	if err != nil {
+		return out, http.StatusBadRequest, err
+	}
+	meta, status, err := queryMetadata(q)
+	if err != nil {
+		return out, status, err
+	}
+	res, used, err := rd.renderWith(r.Context(), mode, svg, size, s)
+	if err != nil {
+		return out, http.StatusInternalServerError, err
+	}
+	out.Renderer = used
+	data, err := postProcess(res, post)
+	if err != nil {
+		return out, http.StatusInternalServerError, err
+	}
+	if format == "png" {
+		out.ContentType = "image/png"
+		if data, err = meta.renderedBy(rd, used).embed(data, svg); err != nil {
+			return out, http.StatusInternalServerError, err
+		}
+	} else {
+		out.ContentType = f.contentType
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return out, http.StatusInternalServerError, err
+		}
+		if data, err = f.encode(img, q, meta.dpi); err != nil {
+			return out, http.StatusBadRequest, err
+		}
+	}
+	out.Data = base64.StdEncoding.EncodeToString(data)
+	return out, http.StatusOK, nil
+}
+
+// renderHandler renders the svg of a json request to all requested outputs
+func renderHandler(rd *renderer, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := cfg.limits.readBody(r)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		var req renderRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			logrus.Warn(err)
+			writeError(w, r, errors.Wrap(err, "invalid json"), http.StatusBadRequest)
+			return
+		}
+		var svg []byte
+		switch {
+		case req.SVG != "":
+			if svg, err = decodeSVGInput(req.SVG); err == nil {
+				svg, err = decompress(svg, "", cfg.limits.bodySize)
+			}
+		case req.ID != "":
+			svg, err = cfg.storedSVG(req.ID)
+		case req.Src != "" && cfg.fetcher != nil:
+			svg, err = cfg.fetcher.fetch(r.Context(), req.Src)
+		case req.Src != "":
+			err = newError(http.StatusForbidden, codeAssetBlocked, errors.New("fetching svgs is disabled"))
+		default:
+			err = errors.New("svg, src or id is required")
+		}
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		if len(req.Outputs) > maxOutputs {
+			writeError(w, r, fmt.Errorf("at most %d outputs are allowed", maxOutputs), http.StatusBadRequest)
+			return
+		}
+		base := url.Values{}
+		if err := optionValues(base, req.Options); err != nil {
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		size, _, err := svgParams(svg, base, cfg)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		if len(req.Outputs) == 0 {
+			req.Outputs = []outputRequest{{Format: "png"}}
+		}
+
+		resp := renderResponse{Width: size.Width, Height: size.Height, Outputs: make([]renderOutput, len(req.Outputs))}
+		total := 0.0
+		for i, o := range req.Outputs {
+			q := url.Values{}
+			for k, v := range base {
+				q[k] = v
+			}
+			if err := optionValues(q, o.Options); err != nil {
+				writeError(w, r, err, http.StatusBadRequest)
+				return
+			}
+			format := strings.ToLower(o.Format)
+			if format == "" {
+				format = "png"
+			}
+			var status int
+			if resp.Outputs[i], status, err = renderOne(r, rd, cfg, svg, format, q, &total); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, errors.Wrapf(err, "output %d", i), status)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// limits protect the chrome instances from huge requests. 0 disables a
+// limit.
+type limits struct {
+	bodySize  int64   // bytes
+	dimension float64 // width or height of the svg in CSS pixels
+	pixels    float64 // of a rendered image
+	total     float64 // pixels of all images of a request, e.g. frames
+	elements  int
+}
+
+// limitError is a request exceeding one of the limits, reported with the
+// too_large code
+type limitError struct {
+	status int
+	Reason string
+	Limit  float64
+	Actual float64
+}
+
+func (e *limitError) Error() string {
+	return e.Reason
+}
+
+// readBody reads the request body up to the body size limit and decompresses
+// it, see decompress
+func (l limits) readBody(r *http.Request) ([]byte, error) {
+	if l.bodySize <= 0 {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return decompress(body, r.Header.Get("Content-Encoding"), 0)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, l.bodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > l.bodySize {
+		return nil, l.bodyTooLarge()
+	}
+	return decompress(body, r.Header.Get("Content-Encoding"), l.bodySize)
+}
+
+func (l limits) bodyTooLarge() error {
+	return &limitError{
+		status: http.StatusRequestEntityTooLarge,
+		Reason: fmt.Sprintf("request body is larger than %d bytes", l.bodySize),
+		Limit:  float64(l.bodySize),
+	}
+}
+
+// countingBody counts the bytes read from a request body. Below
+// http.MaxBytesReader it tells whether a read error is due to the limit.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// checkPixels checks the size of an image to be rendered
+func (l limits) checkPixels(w, h float64) error {
+	w, h = math.Ceil(w), math.Ceil(h)
+	if l.pixels > 0 && w*h > l.pixels {
+		return &limitError{
+			status: http.StatusUnprocessableEntity,
+			Reason: fmt.Sprintf("%gx%g pixels exceed the budget of %.0f pixels", w, h, l.pixels),
+			Limit:  l.pixels,
+			Actual: w * h,
+		}
+	}
+	return nil
+}
+
+// stricter returns the stricter of two limits, 0 is unlimited
+func stricter(a, b float64) float64 {
+	if a <= 0 || b > 0 && b < a {
+		return b
+	}
+	return a
+}
+
+// checkTotal checks the number of pixels of all images of a request
+func (l limits) checkTotal(pixels float64) error {
+	if l.total > 0 && pixels > l.total {
+		return &limitError{
+			status: http.StatusUnprocessableEntity,
+			Reason: fmt.Sprintf("%.0f pixels in total exceed the budget of %.0f pixels", pixels, l.total),
+			Limit:  l.total,
+			Actual: pixels,
+		}
+	}
+	return nil
+}
+
+// checkSizes checks the square images of the sizes parameter, each and in
+// total
+func (l limits) checkSizes(sizes []int) error {
+	total := 0.0
+	for _, n := range sizes {
+		if err := l.checkPixels(float64(n), float64(n)); err != nil {
+			return err
+		}
+		total += float64(n) * float64(n)
+	}
+	return l.checkTotal(total)
+}
+
+// checkSVG checks the size and element count of an svg and the number of
+// pixels of the shot
+func (l limits) checkSVG(svg []byte, size svgSize, s shot) error {
+	if l.dimension > 0 && (size.Width > l.dimension || size.Height > l.dimension) {
+		return &limitError{
+			status: http.StatusUnprocessableEntity,
+			Reason: fmt.Sprintf("svg is %s CSS pixels, at most %g per side are allowed", size, l.dimension),
+			Limit:  l.dimension,
+			Actual: math.Max(size.Width, size.Height),
+		}
+	}
+	scale := s.scaleFor(size.Width, size.Height)
+	if err := l.checkPixels(size.Width*scale, size.Height*scale); err != nil {
+		return err
+	}
+	if l.elements <= 0 {
+		return nil
+	}
+	n, err := countElements(svg, l.elements)
+	if err != nil {
+		return err
+	}
+	if n > l.elements {
+		return &limitError{
+			status: http.StatusUnprocessableEntity,
+			Reason: fmt.Sprintf("svg has more than %d elements", l.elements),
+			Limit:  float64(l.elements),
+		}
+	}
+	return nil
+}
+
+// countElements counts the elements of an svg, stopping after max+1
+func countElements(data []byte, max int) (int, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	n := 0
+	for n <= max {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, newError(http.StatusBadRequest, codeInvalidSVG, errors.Wrap(err, "could not parse svg"))
+		}
+		if _, ok := t.(xml.StartElement); ok {
+			n++
+		}
+	}
+	return n, nil
+}
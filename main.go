@@ -1,14 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/sha256"
+	"crypto/rand"
+	"encoding/base64"
 	"net"
 	"os"
+	"strconv"
 
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
@@ -16,12 +18,16 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/chromedp/cdproto/emulation"
 	"github.com/chromedp/chromedp"
 	"github.com/chromedp/chromedp/client"
 	"github.com/namsral/flag"
 	"github.com/pkg/errors"
 )
 
+// version of svg2png, set with -ldflags "-X main.version=..."
+var version = "dev"
+
 type imageMap struct {
 	sync.RWMutex
 	m map[string][]byte
@@ -54,6 +60,114 @@ func (im *imageMap) Get(h string) ([]byte, bool) {
 	return bytes, ok
 }
 
+// config holds the settings shared by the rendering handlers
+type config struct {
+	defaultSize   svgSize
+	limits        limits
+	watermarks    *watermarkMap
+	fetcher       *fetcher          // nil if svgs may not be fetched from urls
+	store         *svgStore         // nil if svgs can not be stored
+	watermarkKeys map[string]string // api key to enforced watermark
+	keys          *keyStore         // nil if no api key is required
+
+	renderTimeout    time.Duration // default deadline of a request
+	maxRenderTimeout time.Duration // largest deadline a request may ask for
+}
+
+// timeout returns the render deadline of the request: the timeout parameter
+// (a duration like 5s or seconds) up to the maximum, or the default. 0
+// disables the deadline.
+func (cfg *config) timeout(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("timeout")
+	if s == "" {
+		return cfg.renderTimeout, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		secs, perr := strconv.ParseFloat(s, 64)
+		if perr != nil || secs <= 0 {
+			return 0, fmt.Errorf("invalid timeout '%s'", s)
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 || cfg.maxRenderTimeout > 0 && d > cfg.maxRenderTimeout {
+		return 0, fmt.Errorf("timeout must be positive and at most %s", cfg.maxRenderTimeout)
+	}
+	return d, nil
+}
+
+// withTimeout runs h with the render deadline of the request, see timeout
+func (cfg *config) withTimeout(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, err := cfg.timeout(r)
+		if err != nil {
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		if d <= 0 {
+			h(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// postOptions parses the post-processing options of the request, including
+// the watermark enforced for its api key, for the shot s of an svg of the
+// given size
+func (cfg *config) postOptions(r *http.Request, size svgSize, s shot) (postOptions, error) {
+	return cfg.queryPostOptions(r.URL.Query(), r, size, s)
+}
+
+// queryPostOptions parses the post-processing options of q for the request,
+// see postOptions. The size of the post-processed image is checked against
+// the pixel budgets.
+func (cfg *config) queryPostOptions(q url.Values, r *http.Request, size svgSize, s shot) (postOptions, error) {
+	o, err := parsePostOptions(q)
+	if err != nil {
+		return o, err
+	}
+	w, h := o.outputSize(s.imageSize(size))
+	if err := cfg.limits.checkPixels(w, h); err != nil {
+		return o, err
+	}
+	if err := keyLimits(r).checkPixels(w, h); err != nil {
+		return o, err
+	}
+	o.watermark, err = parseWatermark(q, cfg.watermarks, cfg.enforcedWatermark(requestKey(r)))
+	return o, err
+}
+
+// checkTotal checks the pixels of all images of a request against the global
+// and the api key budget
+func (cfg *config) checkTotal(r *http.Request, pixels float64) error {
+	if err := cfg.limits.checkTotal(pixels); err != nil {
+		return err
+	}
+	return keyLimits(r).checkTotal(pixels)
+}
+
+// checkSizes checks the square images of the sizes parameter against the
+// global and the api key budgets
+func (cfg *config) checkSizes(r *http.Request, sizes []int) error {
+	if err := cfg.limits.checkSizes(sizes); err != nil {
+		return err
+	}
+	return keyLimits(r).checkSizes(sizes)
+}
+
+// enforcedWatermark returns the watermark enforced for an api key, from the
+// key store if api keys are required
+func (cfg *config) enforcedWatermark(key string) string {
+	if cfg.keys != nil {
+		k, _ := cfg.keys.Get(key)
+		return k.Watermark
+	}
+	return cfg.watermarkKeys[key]
+}
+
 func main() {
 	fs := flag.NewFlagSetWithEnvPrefix(os.Args[0], "SVG2PNG", 0)
 	flagPort := fs.Int("port", 8544, "port to listen to")
@@ -61,6 +175,38 @@ func main() {
 	flagURLs := fs.String("urls", "", "urls to chrome rdp (csv)")
 	flagHosts := fs.String("hosts", "", "hosts with running chrome rdp (csv)")
 	flagSelf := fs.String("self", "svg2png", "url under which chrome can reach this service (port is added automatically)")
+	flagDefaultWidth := fs.Float64("default-width", 300, "width in px for svgs without width and viewBox")
+	flagDefaultHeight := fs.Float64("default-height", 150, "height in px for svgs without height and viewBox")
+	flagMaxBodySize := fs.Int64("max-body-size", 10<<20, "maximum request body size in bytes (0 disables the limit)")
+	flagMaxDimension := fs.Float64("max-dimension", 10000, "maximum width or height of an svg in CSS pixels (0 disables the limit)")
+	flagMaxPixels := fs.Float64("max-pixels", 50e6, "maximum number of pixels of a rendered image (0 disables the limit)")
+	flagMaxTotalPixels := fs.Float64("max-total-pixels", 500e6, "maximum number of pixels of all images of a request, e.g. frames or icon sizes (0 disables the limit)")
+	flagMaxElements := fs.Int("max-elements", 100000, "maximum number of elements of an svg (0 disables the limit)")
+	flagTemplates := fs.String("templates", "", "directory with svg templates to register on startup")
+	flagWatermarks := fs.String("watermarks", "", "directory with png watermarks to register on startup")
+	flagFallbackWait := fs.Duration("fallback-wait", 0, "render simple svgs in go if no chrome is available within this time (0 disables the fallback)")
+	flagRenderTimeout := fs.Duration("render-timeout", 30*time.Second, "default deadline of a render request (0 disables it)")
+	flagMaxRenderTimeout := fs.Duration("max-render-timeout", 2*time.Minute, "maximum deadline a request may set with timeout= (0 allows any)")
+	flagSrcHosts := fs.String("src-hosts", "", "hosts svgs may be fetched from with src= (csv, *.example.com allows subdomains, empty disables src)")
+	flagSrcTimeout := fs.Duration("src-timeout", 10*time.Second, "timeout for fetching an svg")
+	flagSrcRedirects := fs.Int("src-redirects", 3, "maximum number of redirects when fetching an svg")
+	flagSrcCache := fs.Int("src-cache", 100, "number of fetched svgs to cache (0 disables the cache)")
+	flagWatermarkKeys := fs.String("watermark-keys", "", "watermarks enforced per api key (csv of key=name or key=text:<text>)")
+	flagURLSecret := fs.String("url-secret", "", "secret for signed GET /v1/png/{signature} urls (empty disables them)")
+	flagURLMaxAge := fs.Duration("url-max-age", 24*time.Hour, "max-age of the Cache-Control header of signed urls")
+	flagStore := fs.String("store", "none", "backend of the svg store: memory, dir, s3 or none")
+	flagStoreMaxSize := fs.Int64("store-max-size", 100<<20, "maximum total size of the memory svg store in bytes (0 disables the limit)")
+	flagStoreDir := fs.String("store-dir", "svgs", "directory of the dir svg store")
+	flagStoreTTL := fs.Duration("store-ttl", 24*time.Hour, "how long stored svgs are kept after their last upload (0 keeps them forever)")
+	flagStoreGC := fs.Duration("store-gc-interval", 10*time.Minute, "how often expired svgs are deleted")
+	flagS3Endpoint := fs.String("s3-endpoint", "", "url of the S3-compatible service of the s3 svg store")
+	flagS3Bucket := fs.String("s3-bucket", "", "bucket of the s3 svg store")
+	flagS3Prefix := fs.String("s3-prefix", "svgs/", "prefix of the object keys of the s3 svg store")
+	flagS3Region := fs.String("s3-region", "us-east-1", "region of the s3 svg store")
+	flagS3AccessKey := fs.String("s3-access-key", "", "access key of the s3 svg store")
+	flagS3SecretKey := fs.String("s3-secret-key", "", "secret key of the s3 svg store")
+	flagAPIKeys := fs.String("api-keys", "", "json file with the api keys and their limits, requires an api key for all requests")
+	flagAdminKey := fs.String("admin-key", "", "key for the /v1/keys, watermark, template and svg deletion admin api, requires an api key for all requests")
 	fs.Parse(os.Args[1:])
 
 	if *flagHosts == "" && *flagURLs == "" {
@@ -71,28 +217,126 @@ func main() {
 	logrus.SetLevel(logrus.DebugLevel)
 	chromes, err := createCDPClients(*flagURLs, *flagHosts, *flagTimeout)
 	if err != nil {
-		logrus.Fatal(err)
+		logrus.WithField("code", classify(err, http.StatusServiceUnavailable).Code).Fatal(err)
 	}
 	images := NewImageMap()
+	cfg := &config{
+		defaultSize: svgSize{Width: *flagDefaultWidth, Height: *flagDefaultHeight},
+		limits: limits{
+			bodySize:  *flagMaxBodySize,
+			dimension: *flagMaxDimension,
+			pixels:    *flagMaxPixels,
+			total:     *flagMaxTotalPixels,
+			elements:  *flagMaxElements,
+		},
+		watermarks:       NewWatermarkMap(),
+		renderTimeout:    *flagRenderTimeout,
+		maxRenderTimeout: *flagMaxRenderTimeout,
+	}
+	if hosts := parseHosts(*flagSrcHosts); len(hosts) > 0 {
+		cfg.fetcher = NewFetcher(hosts, *flagSrcTimeout, *flagSrcRedirects, *flagSrcCache, *flagMaxBodySize)
+	}
+	var backend svgBackend
+	switch *flagStore {
+	case "memory":
+		backend = NewMemoryBackend(*flagStoreMaxSize)
+	case "dir":
+		backend, err = NewDirBackend(*flagStoreDir)
+	case "s3":
+		backend, err = NewS3Backend(*flagS3Endpoint, *flagS3Bucket, *flagS3Prefix, *flagS3Region, *flagS3AccessKey, *flagS3SecretKey)
+	case "none", "":
+	default:
+		err = fmt.Errorf("unsupported store '%s', expected memory, dir, s3 or none", *flagStore)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if backend != nil {
+		cfg.store = NewSVGStore(backend, *flagStoreTTL)
+		if *flagStoreTTL > 0 && *flagStoreGC > 0 {
+			go cfg.store.RunGC(*flagStoreGC)
+		}
+	}
+	if *flagWatermarks != "" {
+		if err := cfg.watermarks.LoadDir(*flagWatermarks); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	if cfg.watermarkKeys, err = parseWatermarkKeys(*flagWatermarkKeys); err != nil {
+		logrus.Fatal(err)
+	}
+	if *flagAPIKeys != "" || *flagAdminKey != "" {
+		cfg.keys = NewKeyStore(*flagAdminKey)
+		if *flagAPIKeys != "" {
+			if err := cfg.keys.LoadFile(*flagAPIKeys); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		// watermark keys are valid api keys without limits
+		for key, wm := range cfg.watermarkKeys {
+			k, ok := cfg.keys.Get(key)
+			if !ok {
+				k = apiKey{Key: key}
+			}
+			if k.Watermark == "" {
+				k.Watermark = wm
+			}
+			cfg.keys.Put(k)
+		}
+	}
+	templates := NewTemplateMap()
+	if *flagTemplates != "" {
+		if err := templates.LoadDir(*flagTemplates); err != nil {
+			logrus.Fatal(err)
+		}
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1/svg-html/", htmlHandler)
 	mux.HandleFunc("/v1/svg-data/", dataHandler(images))
-	mux.HandleFunc("/v1/png", mainHandler(images, chromes, selfURL))
+	rd := NewRenderer(images, chromes, selfURL, *flagFallbackWait)
+	auth := cfg.keys.require
+	mux.HandleFunc("/v1/png", auth("png", cfg.withTimeout(mainHandler(rd, cfg))))
+	mux.HandleFunc("/v1/sprite", auth("png", cfg.withTimeout(spriteHandler(rd, cfg))))
+	mux.HandleFunc("/v1/ico", auth("ico", cfg.withTimeout(icoHandler(rd, cfg))))
+	mux.HandleFunc("/v1/tiff", auth("tiff", cfg.withTimeout(rasterHandler(rd, cfg, "tiff"))))
+	mux.HandleFunc("/v1/bmp", auth("bmp", cfg.withTimeout(rasterHandler(rd, cfg, "bmp"))))
+	mux.HandleFunc("/v1/diff", auth("png", cfg.withTimeout(diffHandler(rd, cfg))))
+	// batches have a deadline per record, see renderTemplate
+	mux.HandleFunc("/v1/templates/", templateHandler(templates, rd, cfg))
+	mux.HandleFunc("/v1/watermarks/", watermarkHandler(cfg))
+	mux.HandleFunc("/v2/render", auth("", cfg.withTimeout(renderHandler(rd, cfg))))
+	if cfg.store != nil {
+		mux.HandleFunc("/v1/svgs", svgStoreHandler(cfg.store, cfg))
+		mux.HandleFunc("/v1/svgs/", svgStoreHandler(cfg.store, cfg))
+	}
+	if *flagURLSecret != "" {
+		sg := &signer{secret: []byte(*flagURLSecret), maxAge: *flagURLMaxAge}
+		mux.HandleFunc("/v1/png/", cfg.withTimeout(signedHandler(sg, templates, rd, cfg)))
+	}
+	if cfg.keys != nil {
+		mux.HandleFunc("/v1/usage", usageHandler(cfg.keys))
+		mux.HandleFunc("/v1/keys", keyHandler(cfg.keys))
+		mux.HandleFunc("/v1/keys/", keyHandler(cfg.keys))
+	}
 	mux.HandleFunc("/healthz", healthzHandler)
 
 	logrus.Debugf("listening on :%d", *flagPort)
-	http.ListenAndServe(fmt.Sprintf(":%d", *flagPort), mux)
+	http.ListenAndServe(fmt.Sprintf(":%d", *flagPort), withRequestID(withGzip(mux)))
 }
 
-func fetchImages(url *url.URL, res *[]byte) chromedp.Tasks {
+func fetchImages(url *url.URL, size svgSize, s shot, res *[]byte) chromedp.Tasks {
 	sel := `#svg`
+	w, h := size.pixels()
 	return chromedp.Tasks{
+		emulation.SetDeviceMetricsOverride(int64(w), int64(h), 1, false),
+		transparentBackground(),
 		chromedp.Navigate(url.String()),
 		//chromedp.Sleep(2000 * time.Millisecond),
-		chromedp.WaitVisible(sel, chromedp.ByID),
+		waitLoaded(),
+		fitViewport(sel, s),
 		//chromedp.WaitNotVisible(`div.v-middle > div.la-ball-clip-rotate`, chromedp.ByQuery),
-		chromedp.Screenshot(sel, res, chromedp.NodeVisible, chromedp.ByID),
+		screenshot(sel, s, res),
 		//chromedp.CaptureScreenshot(res),
 	}
 }
@@ -146,7 +390,8 @@ func createCDPClients(url, host string, timeout int) (chan *chromedp.CDP, error)
 			logrus.Debugf("trying '%s' again after %s", u, err)
 		}
 		if err != nil {
-			return nil, err
+			return nil, newError(http.StatusServiceUnavailable, codeChromeUnavailable,
+				errors.Wrapf(err, "could not connect to '%s'", u))
 		}
 		chromes <- c
 	}
@@ -156,9 +401,27 @@ func createCDPClients(url, host string, timeout int) (chan *chromedp.CDP, error)
 
 func htmlHandler(w http.ResponseWriter, r *http.Request) {
 	ch := r.URL.Path[len("/v1/svg-html/"):]
+	q := r.URL.Query()
+	dataURL := "/v1/svg-data/" + ch
 	w.Header().Set("Content-Type", "text/html")
 
-	w.Write([]byte(`<html><body><img id="svg" src="/v1/svg-data/` + ch + `" /></body></html>`))
+	width, _ := strconv.ParseFloat(q.Get("w"), 64)
+	height, _ := strconv.ParseFloat(q.Get("h"), 64)
+	size := svgSize{Width: width, Height: height}
+	var at *float64
+	if t, err := strconv.ParseFloat(q.Get("t"), 64); err == nil {
+		at = &t
+	}
+	bbox := q.Get("bbox") != ""
+	if el := q.Get("el"); el != "" || at != nil || bbox {
+		var b [16]byte
+		rand.Read(b[:])
+		nonce := base64.StdEncoding.EncodeToString(b[:])
+		w.Header().Set("Content-Security-Policy", fmt.Sprintf(inlineCSP, nonce))
+		w.Write([]byte(inlinePage(dataURL, nonce, el, at, bbox, size)))
+		return
+	}
+	w.Write([]byte(imagePage(dataURL, size)))
 }
 
 func dataHandler(images *imageMap) http.HandlerFunc {
@@ -168,56 +431,192 @@ func dataHandler(images *imageMap) http.HandlerFunc {
 		bytes, ok := images.Get(ch)
 		if !ok {
 			logrus.Warn(ch)
-			http.Error(w, "404 Image not found", http.StatusNotFound)
+			writeError(w, r, errors.New("image not found"), http.StatusNotFound)
 			return
 		}
 		w.Header().Set("Content-Type", "image/svg+xml")
 		bw, err := w.Write(bytes)
 		if err != nil {
 			logrus.Warn(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 		if bw != len(bytes) {
 			logrus.Warnf("incomplete write %s: %d/%d", ch, bw, len(bytes))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, io.ErrShortWrite, http.StatusInternalServerError)
 			return
 		}
 	}
 }
 
-func mainHandler(images *imageMap, chromes chan *chromedp.CDP, selfURL string) http.HandlerFunc {
+// readSVG reads the svg of the request (see readInput) and returns it with its size
+// and the shot selected by the request. On error the status to respond with
+// is returned.
+func readSVG(r *http.Request, cfg *config) ([]byte, svgSize, shot, int, error) {
+	body, err := cfg.readInput(r)
+	if err != nil {
+		return nil, svgSize{}, shot{}, http.StatusInternalServerError, err
+	}
+	size, s, err := keySVGParams(r, body, r.URL.Query(), cfg)
+	if err != nil {
+		return nil, svgSize{}, shot{}, http.StatusBadRequest, err
+	}
+	return body, size, s, http.StatusOK, nil
+}
+
+// svgParams returns the size of the svg and the shot selected by the query.
+// width and height override the size of the svg and may use physical units,
+// dpi sets the number of device pixels per inch (96 CSS pixels). The result
+// is checked against the limits of cfg.
+func svgParams(svg []byte, q url.Values, cfg *config) (svgSize, shot, error) {
+	size, err := intrinsicSize(svg, cfg.defaultSize)
+	if err != nil {
+		return svgSize{}, shot{}, newError(http.StatusBadRequest, codeInvalidSVG, err)
+	}
+	if size, err = outputSize(q, size); err != nil {
+		return svgSize{}, shot{}, err
+	}
+	dpi, err := parseDPI(q)
+	if err != nil {
+		return svgSize{}, shot{}, err
+	}
+	s := shot{params: pageParams(size), scale: dpi / cssDPI, budget: cfg.limits.pixels}
+	if el := strings.TrimPrefix(q.Get("element"), "#"); el != "" {
+		if _, err := findElement(svg, el); err != nil {
+			return svgSize{}, shot{}, err
+		}
+		s.params.Set("el", el)
+	}
+	if t := q.Get("time"); t != "" {
+		if v, err := strconv.ParseFloat(t, 64); err != nil || v < 0 {
+			return svgSize{}, shot{}, fmt.Errorf("invalid time '%s'", t)
+		}
+		s.params.Set("t", t)
+	}
+	if q.Get("trim") == "bbox" {
+		s.params.Set("bbox", "1")
+	}
+	if err := cfg.limits.checkSVG(svg, size, s); err != nil {
+		return svgSize{}, shot{}, err
+	}
+	return size, s, nil
+}
+
+// keySVGParams is svgParams, also checked against the limits of the api key
+// of the request
+func keySVGParams(r *http.Request, svg []byte, q url.Values, cfg *config) (svgSize, shot, error) {
+	size, s, err := svgParams(svg, q, cfg)
+	if err != nil {
+		return svgSize{}, shot{}, err
+	}
+	l := keyLimits(r)
+	if err := l.checkSVG(svg, size, s); err != nil {
+		return svgSize{}, shot{}, err
+	}
+	s.budget = stricter(s.budget, l.pixels)
+	return size, s, nil
+}
+
+func mainHandler(rd *renderer, cfg *config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		h := sha256.New()
-		h.Write([]byte(time.Now().UTC().String()))
-		body, err := ioutil.ReadAll(io.TeeReader(r.Body, h))
+		body, size, s, status, err := readSVG(r, cfg)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, status)
+			return
+		}
+		post, err := cfg.postOptions(r, size, s)
 		if err != nil {
 			logrus.Warn(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err, http.StatusBadRequest)
 			return
 		}
-		ch := fmt.Sprintf("%x.svg", h.Sum([]byte{}))
-		images.Add(ch, body)
-		defer images.Remove(ch)
-		imageURL, err := url.Parse(fmt.Sprintf("%s%s", selfURL, ch))
+		mode, err := parseRendererMode(r.URL.Query())
 		if err != nil {
 			logrus.Warn(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err, http.StatusBadRequest)
 			return
 		}
+		meta, status, err := requestMetadata(r)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, status)
+			return
+		}
+		w.Header().Set("X-SVG-Width", strconv.FormatFloat(size.Width, 'g', -1, 64))
+		w.Header().Set("X-SVG-Height", strconv.FormatFloat(size.Height, 'g', -1, 64))
 
-		var res []byte
-		c := <-chromes
-		err = c.Run(r.Context(), fetchImages(imageURL, &res))
-		chromes <- c
+		if v := r.URL.Query().Get("sizes"); v != "" {
+			sizes, err := parseSizes(v)
+			if err == nil {
+				err = cfg.checkSizes(r, sizes)
+			}
+			if err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusBadRequest)
+				return
+			}
+			res, err := renderIcons(r, rd, body, size, s.params, sizes, post.watermark)
+			if err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			names := make([]string, len(sizes))
+			for i, n := range sizes {
+				names[i] = fmt.Sprintf("%dx%d.png", n, n)
+			}
+			var buf bytes.Buffer
+			if err := writeZip(&buf, names, res); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("Content-Disposition", `attachment; filename="icons.zip"`)
+			w.Write(buf.Bytes())
+			return
+		}
+
+		fr, ok, err := parseFrameRange(r.URL.Query())
 		if err != nil {
 			logrus.Warn(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		if ok {
+			fw, fh := s.imageSize(size)
+			if err := cfg.checkTotal(r, float64(len(fr.times()))*fw*fh); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusUnprocessableEntity)
+				return
+			}
+			frameHandler(w, r, rd, body, size, s, fr, post.watermark)
+			return
+		}
+
+		res, used, err := rd.renderWith(r.Context(), mode, body, size, s)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Renderer", used)
+		out, err := postProcess(res, post)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		setBytesSaved(w, post, len(res), len(out))
+		if out, err = meta.renderedBy(rd, used).embed(out, body); err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "image/png")
-		w.Write(res)
+		w.Write(out)
 	}
 }
 
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"unicode/utf8"
+)
+
+// metadata is embedded into png outputs: a pHYs chunk if a dpi was
+// requested and text chunks describing where the png came from if
+// metadata=true was requested
+type metadata struct {
+	dpi        float64
+	provenance bool
+	options    string
+	renderer   string // that rendered the png, see renderedBy
+	chrome     string
+}
+
+// requestMetadata reads the dpi and metadata parameters of the request. On
+// error the status to respond with is returned.
+func requestMetadata(r *http.Request) (metadata, int, error) {
+	return queryMetadata(r.URL.Query())
+}
+
+// queryMetadata reads the dpi and metadata parameters of q, see
+// requestMetadata
+func queryMetadata(q url.Values) (metadata, int, error) {
+	dpi, err := parseDPI(q)
+	if err != nil {
+		return metadata{}, http.StatusBadRequest, err
+	}
+	m := metadata{dpi: dpi}
+	if s := q.Get("metadata"); s != "" {
+		if m.provenance, err = strconv.ParseBool(s); err != nil {
+			return m, http.StatusBadRequest, fmt.Errorf("invalid metadata '%s'", s)
+		}
+	}
+	if m.provenance {
+		m.options = q.Encode()
+	}
+	return m, http.StatusOK, nil
+}
+
+// renderedBy records the renderer used for the png and, for chrome, the
+// version it reported while rendering
+func (m metadata) renderedBy(rd *renderer, used string) metadata {
+	m.renderer, m.chrome = used, ""
+	if used == chromeRenderer {
+		m.chrome = rd.version()
+	}
+	return m
+}
+
+// textChunk returns a tEXt chunk, or a utf-8 iTXt chunk if the value is not
+// plain ascii
+func textChunk(key, value string) pngChunk {
+	ascii := true
+	for i := 0; i < len(value); i++ {
+		if value[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii || !utf8.ValidString(value) {
+		return pngChunk{typ: "tEXt", data: []byte(key + "\x00" + value)}
+	}
+	// no compression, no language tag, no translated keyword
+	return pngChunk{typ: "iTXt", data: []byte(key + "\x00\x00\x00\x00\x00" + value)}
+}
+
+// physChunk returns a pHYs chunk with the dpi converted to pixels per meter
+func physChunk(dpi float64) pngChunk {
+	data := make([]byte, 9)
+	ppm := uint32(math.Round(dpi / 0.0254))
+	binary.BigEndian.PutUint32(data[0:], ppm)
+	binary.BigEndian.PutUint32(data[4:], ppm)
+	data[8] = 1 // unit is the meter
+	return pngChunk{typ: "pHYs", data: data}
+}
+
+// embed writes the metadata of the png rendered from svg right after its
+// IHDR chunk, replacing an existing pHYs chunk
+func (m metadata) embed(data, svg []byte) ([]byte, error) {
+	if m.dpi == 0 && !m.provenance {
+		return data, nil
+	}
+	chunks, err := readChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	var added []pngChunk
+	if m.dpi > 0 {
+		added = append(added, physChunk(m.dpi))
+	}
+	if m.provenance {
+		added = append(added,
+			textChunk("Software", "svg2png "+version),
+			textChunk("svg2png:sha256", fmt.Sprintf("%x", sha256.Sum256(svg))),
+			textChunk("svg2png:options", m.options),
+			textChunk("svg2png:renderer", m.renderer),
+		)
+		if m.chrome != "" {
+			added = append(added, textChunk("svg2png:chrome", m.chrome))
+		}
+	}
+
+	res := make([]pngChunk, 0, len(chunks)+len(added))
+	for _, c := range chunks {
+		if c.typ == "pHYs" && m.dpi > 0 {
+			continue
+		}
+		res = append(res, c)
+		if c.typ == "IHDR" {
+			res = append(res, added...)
+		}
+	}
+	return writeChunks(res), nil
+}
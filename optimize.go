@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+var compressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// parseOptimizeOptions reads compression, optimize, colors, dither and strip
+// from the query into o
+func parseOptimizeOptions(q url.Values, o *postOptions) error {
+	if c := q.Get("compression"); c != "" {
+		level, ok := compressionLevels[c]
+		if !ok {
+			return fmt.Errorf("unsupported compression '%s', expected default, none, speed or best", c)
+		}
+		o.compression = level
+		o.reencode = true
+	}
+	for _, p := range []struct {
+		name string
+		v    *bool
+	}{{"optimize", &o.palette}, {"dither", &o.dither}, {"strip", &o.strip}} {
+		if s := q.Get(p.name); s != "" {
+			v, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("invalid %s '%s'", p.name, s)
+			}
+			*p.v = v
+		}
+	}
+	if s := q.Get("colors"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 2 || n > 256 {
+			return fmt.Errorf("invalid colors '%s', must be between 2 and 256", s)
+		}
+		o.colors = n
+	}
+	return nil
+}
+
+// optimized reports whether any size optimization was requested
+func (o postOptions) optimized() bool {
+	return o.reencode || o.palette || o.colors > 0 || o.strip
+}
+
+// setBytesSaved reports the effect of size optimizations in a header
+func setBytesSaved(w http.ResponseWriter, o postOptions, before, after int) {
+	if o.optimized() {
+		w.Header().Set("X-Bytes-Saved", strconv.Itoa(before-after))
+	}
+}
+
+// toPalette converts img to a paletted image if it has at most 256 colors.
+// ok is false if there are more.
+func toPalette(img image.Image) (*image.Paletted, bool) {
+	src := imaging.Clone(img)
+	index := map[color.NRGBA]uint8{}
+	var pal color.Palette
+	for i := 0; i < len(src.Pix); i += 4 {
+		c := color.NRGBA{src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3]}
+		if c.A == 0 {
+			c = color.NRGBA{}
+		}
+		if _, ok := index[c]; ok {
+			continue
+		}
+		if len(pal) == 256 {
+			return nil, false
+		}
+		index[c] = uint8(len(pal))
+		pal = append(pal, c)
+	}
+
+	b := src.Bounds()
+	dst := image.NewPaletted(b, pal)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			i := src.PixOffset(x, y)
+			c := color.NRGBA{src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3]}
+			if c.A == 0 {
+				c = color.NRGBA{}
+			}
+			dst.Pix[dst.PixOffset(b.Min.X+x, b.Min.Y+y)] = index[c]
+		}
+	}
+	return dst, true
+}
+
+// quantize reduces img to n colors using median cut
+func quantize(img image.Image, n int, dither bool) *image.Paletted {
+	pal := medianCut{}.Quantize(make(color.Palette, 0, n), img)
+	dst := image.NewPaletted(img.Bounds(), pal)
+	drawer := draw.Drawer(draw.Src)
+	if dither {
+		drawer = draw.FloydSteinberg
+	}
+	drawer.Draw(dst, dst.Bounds(), img, img.Bounds().Min)
+	return dst
+}
+
+// medianCut is a draw.Quantizer that splits the color space of an image into
+// boxes with an equal number of pixels
+type medianCut struct{}
+
+type colorCount struct {
+	c [4]uint8
+	n int
+}
+
+type colorBox []colorCount
+
+// widest returns the channel with the largest range and that range
+func (b colorBox) widest() (int, int) {
+	ch, width := 0, -1
+	for i := 0; i < 4; i++ {
+		lo, hi := 255, 0
+		for _, cc := range b {
+			if int(cc.c[i]) < lo {
+				lo = int(cc.c[i])
+			}
+			if int(cc.c[i]) > hi {
+				hi = int(cc.c[i])
+			}
+		}
+		if hi-lo > width {
+			ch, width = i, hi-lo
+		}
+	}
+	return ch, width
+}
+
+// average returns the pixel weighted mean color of the box
+func (b colorBox) average() color.Color {
+	var sum [4]int
+	total := 0
+	for _, cc := range b {
+		for i := range sum {
+			sum[i] += int(cc.c[i]) * cc.n
+		}
+		total += cc.n
+	}
+	return color.NRGBA{
+		uint8(sum[0] / total), uint8(sum[1] / total),
+		uint8(sum[2] / total), uint8(sum[3] / total),
+	}
+}
+
+// Quantize adds up to cap(p)-len(p) colors of m to p
+func (medianCut) Quantize(p color.Palette, m image.Image) color.Palette {
+	src := imaging.Clone(m)
+	hist := map[[4]uint8]int{}
+	for i := 0; i < len(src.Pix); i += 4 {
+		c := [4]uint8{src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3]}
+		if c[3] == 0 {
+			c = [4]uint8{}
+		}
+		hist[c]++
+	}
+	all := make(colorBox, 0, len(hist))
+	for c, n := range hist {
+		all = append(all, colorCount{c, n})
+	}
+	if len(all) == 0 {
+		return p
+	}
+
+	n := cap(p) - len(p)
+	boxes := []colorBox{all}
+	for len(boxes) < n {
+		// split the box with the widest channel
+		bi, ch, width := -1, 0, 0
+		for i, b := range boxes {
+			if len(b) < 2 {
+				continue
+			}
+			if c, w := b.widest(); w > width {
+				bi, ch, width = i, c, w
+			}
+		}
+		if bi < 0 {
+			break
+		}
+		b := boxes[bi]
+		sort.Slice(b, func(i, j int) bool { return b[i].c[ch] < b[j].c[ch] })
+		total := 0
+		for _, cc := range b {
+			total += cc.n
+		}
+		split, acc := 1, 0
+		for i, cc := range b[:len(b)-1] {
+			acc += cc.n
+			split = i + 1
+			if acc*2 >= total {
+				break
+			}
+		}
+		boxes[bi] = b[:split]
+		boxes = append(boxes, b[split:])
+	}
+	for _, b := range boxes {
+		p = append(p, b.average())
+	}
+	return p
+}
+
+// stripChunks removes all ancillary chunks from a png
+func stripChunks(data []byte) ([]byte, error) {
+	chunks, err := readChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	kept := chunks[:0]
+	for _, c := range chunks {
+		if !c.ancillary() || c.typ == "tRNS" {
+			kept = append(kept, c)
+		}
+	}
+	return writeChunks(kept), nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+	"github.com/pkg/errors"
+)
+
+const pageStyle = `body{margin:0}img{display:block}#src{position:absolute;width:0;height:0;overflow:hidden}`
+
+// loadState is evaluated until the page has shown the svg ("ok") or failed
+// to load it (the reason). The pages set window.svgError on failure.
+const loadState = `(function() {
+	if (window.svgError) {
+		return window.svgError;
+	}
+	var el = document.getElementById('svg');
+	if (!el) {
+		return '';
+	}
+	var r = el.getBoundingClientRect();
+	return r.width > 0 && r.height > 0 ? 'ok' : 'svg has no size (' + r.width + 'x' + r.height + ')';
+})()`
+
+// how often loadState is evaluated
+const loadPollInterval = 20 * time.Millisecond
+
+// inlineCSP is the Content-Security-Policy of the inline page. The svg is
+// part of the page there, so only the page's own script with the nonce may
+// run and nothing but the svg itself and data uris may be loaded.
+const inlineCSP = "default-src 'none'; script-src 'nonce-%s'; connect-src 'self'; " +
+	"style-src 'unsafe-inline'; img-src data:; font-src data:"
+
+// inlineScript loads the svg inline into a hidden container. Scripts, event
+// handler attributes and links to anything but fragments and data uris are
+// removed before it is imported into the page. If an element
+// id is given, that element is rendered through a <use> in a new svg sized
+// to the element's bounding box (or the viewBox of a <symbol>), otherwise the
+// whole svg is shown, cropped to the bounding box of its content if bbox is
+// set. If a time is given, all SMIL and CSS animations are paused at that
+// offset.
+const inlineScript = `(function(cfg) {
+	var ns = 'http://www.w3.org/2000/svg';
+	fetch(cfg.url).then(function(r) { return r.text(); }).then(function(text) {
+		var doc = new DOMParser().parseFromString(text, 'image/svg+xml');
+		var perr = doc.getElementsByTagName('parsererror')[0];
+		if (perr || doc.documentElement.localName !== 'svg') {
+			window.svgError = 'svg could not be parsed' + (perr ? ': ' + perr.textContent : '');
+			return;
+		}
+		var all = doc.getElementsByTagName('*');
+		for (var i = all.length - 1; i >= 0; i--) {
+			var n = all[i];
+			if (n.localName === 'script') {
+				n.parentNode.removeChild(n);
+				continue;
+			}
+			for (var j = n.attributes.length - 1; j >= 0; j--) {
+				var a = n.attributes[j], v = a.value.trim().toLowerCase();
+				if (/^on/i.test(a.localName) ||
+					(a.localName === 'href' || a.localName === 'src') && v[0] !== '#' && v.indexOf('data:') !== 0) {
+					n.removeAttributeNode(a);
+				}
+			}
+		}
+		var root = document.importNode(doc.documentElement, true);
+		var target = root;
+		if (cfg.id) {
+			document.getElementById('src').appendChild(root);
+			var el = document.getElementById(cfg.id);
+			if (!el) {
+				window.svgError = 'element \'' + cfg.id + '\' not found';
+				return;
+			}
+			var svg = document.createElementNS(ns, 'svg'), use = document.createElementNS(ns, 'use');
+			use.setAttribute('href', '#' + cfg.id);
+			svg.appendChild(use);
+			svg.style.display = 'block';
+			document.body.appendChild(svg);
+			var w, h, vb = el.getAttribute('viewBox');
+			if (el.localName === 'symbol' && vb) {
+				var v = vb.trim().split(/[\s,]+/).map(Number);
+				w = parseFloat(el.getAttribute('width')) || v[2];
+				h = parseFloat(el.getAttribute('height')) || v[3];
+				use.setAttribute('width', w);
+				use.setAttribute('height', h);
+			} else {
+				var b = use.getBBox();
+				svg.setAttribute('viewBox', [b.x, b.y, b.width, b.height].join(' '));
+				w = b.width;
+				h = b.height;
+			}
+			svg.setAttribute('width', w);
+			svg.setAttribute('height', h);
+			target = svg;
+		} else {
+			root.style.display = 'block';
+			if (cfg.width > 0 && cfg.height > 0) {
+				root.style.width = cfg.width + 'px';
+				root.style.height = cfg.height + 'px';
+			}
+			target = document.createElement('div');
+			target.style.width = 'max-content';
+			target.appendChild(root);
+			document.body.appendChild(target);
+			if (cfg.bbox) {
+				var bb = root.getBBox(), ctm = root.getScreenCTM();
+				if (bb.width > 0 && bb.height > 0) {
+					root.setAttribute('viewBox', [bb.x, bb.y, bb.width, bb.height].join(' '));
+					root.style.width = bb.width * ctm.a + 'px';
+					root.style.height = bb.height * ctm.d + 'px';
+				}
+			}
+		}
+		if (cfg.time !== null) {
+			root.pauseAnimations();
+			root.setCurrentTime(cfg.time);
+			if (document.getAnimations) {
+				document.getAnimations().forEach(function(a) {
+					a.pause();
+					a.currentTime = cfg.time * 1000;
+				});
+			} else {
+				var style = document.createElement('style');
+				style.textContent = '*{animation-play-state:paused!important;animation-delay:-' + cfg.time + 's!important}';
+				document.head.appendChild(style);
+			}
+		}
+		requestAnimationFrame(function() { target.id = 'svg'; });
+	}).catch(function(e) {
+		window.svgError = 'svg could not be loaded: ' + e;
+	});
+})(%s);`
+
+// imageScript shows the <img> once it is loaded. An svg that fails to decode
+// either fires an error event or loads without a natural size.
+const imageScript = `function svgLoaded(img) {
+	if (img.naturalWidth === 0) {
+		window.svgError = 'svg could not be decoded';
+		return;
+	}
+	img.id = 'svg';
+}`
+
+// imagePage returns the page that shows the whole svg as an <img>, see
+// imageScript
+func imagePage(dataURL string, size svgSize) string {
+	style := ""
+	if size.Width > 0 && size.Height > 0 {
+		style = fmt.Sprintf(` style="width:%gpx;height:%gpx"`, size.Width, size.Height)
+	}
+	return `<html><head><style>` + pageStyle + `</style><script>` + imageScript + `</script></head>` +
+		`<body><img src="` + dataURL + `"` + style +
+		` onload="svgLoaded(this)" onerror="window.svgError='svg could not be loaded'" /></body></html>`
+}
+
+// inlinePage returns the page that shows the svg inline, see inlineScript.
+// time is nil if animations should not be paused. nonce must be the nonce of
+// the inlineCSP the page is served with.
+func inlinePage(dataURL, nonce, id string, time *float64, bbox bool, size svgSize) string {
+	cfg, _ := json.Marshal(struct {
+		URL    string   `json:"url"`
+		ID     string   `json:"id"`
+		Time   *float64 `json:"time"`
+		BBox   bool     `json:"bbox"`
+		Width  float64  `json:"width"`
+		Height float64  `json:"height"`
+	}{dataURL, id, time, bbox, size.Width, size.Height})
+	return `<html><head><style>` + pageStyle + `</style></head>` +
+		`<body><div id="src"></div><script nonce="` + nonce + `">` + fmt.Sprintf(inlineScript, cfg) + `</script></body></html>`
+}
+
+// waitLoaded waits until the page shows the svg, see loadState. If the svg
+// fails to load, an invalid_svg error with the reason is returned right away.
+func waitLoaded() chromedp.Action {
+	return chromedp.ActionFunc(func(ctxt context.Context, h cdp.Executor) error {
+		for {
+			var state string
+			if err := chromedp.Evaluate(loadState, &state).Do(ctxt, h); err != nil {
+				return err
+			}
+			switch state {
+			case "":
+			case "ok":
+				return nil
+			default:
+				return newError(http.StatusUnprocessableEntity, codeInvalidSVG, errors.New(state))
+			}
+			select {
+			case <-time.After(loadPollInterval):
+			case <-ctxt.Done():
+				return ctxt.Err()
+			}
+		}
+	})
+}
+
+// transparentBackground makes the default background of the page
+// transparent, so screenshots are transparent wherever the svg is. cdp.RGBA
+// omits an alpha of 0, which chrome reads as opaque, so the parameters are
+// sent as they are.
+func transparentBackground() chromedp.Action {
+	return chromedp.ActionFunc(func(ctxt context.Context, h cdp.Executor) error {
+		params := json.RawMessage(`{"color":{"r":0,"g":0,"b":0,"a":0}}`)
+		return h.Execute(ctxt, emulation.CommandSetDefaultBackgroundColorOverride, params, nil)
+	})
+}
+
+// boundingBox returns left, top, width and height of the node matching sel
+func boundingBox(ctxt context.Context, h cdp.Executor, sel string) ([]float64, error) {
+	var box []float64
+	js := fmt.Sprintf(`(function(r) { return [r.left, r.top, r.width, r.height]; })(document.querySelector(%q).getBoundingClientRect())`, sel)
+	if err := chromedp.Evaluate(js, &box).Do(ctxt, h); err != nil {
+		return nil, err
+	}
+	if len(box) != 4 {
+		return nil, fmt.Errorf("could not determine size of '%s'", sel)
+	}
+	if box[2] <= 0 || box[3] <= 0 {
+		return nil, fmt.Errorf("'%s' has no size (%gx%g)", sel, box[2], box[3])
+	}
+	return box, nil
+}
+
+// fitViewport resizes the viewport so the node matching sel is fully visible
+// for the screenshot. The viewport must fit into the pixel budget of s.
+func fitViewport(sel string, s shot) chromedp.Action {
+	return chromedp.ActionFunc(func(ctxt context.Context, h cdp.Executor) error {
+		box, err := boundingBox(ctxt, h, sel)
+		if err != nil {
+			return err
+		}
+		width, height := math.Ceil(box[0]+box[2]), math.Ceil(box[1]+box[3])
+		if err := (limits{pixels: s.budget}).checkPixels(width, height); err != nil {
+			return err
+		}
+		return emulation.SetDeviceMetricsOverride(int64(width), int64(height), 1, false).Do(ctxt, h)
+	})
+}
+
+// screenshot captures the node matching sel as png. The node is scaled by
+// s.scale, or so that its larger side is s.fit pixels. The measured size, e.g.
+// of an element or the bounding box, is checked against the pixel budget of
+// s before the capture.
+func screenshot(sel string, s shot, res *[]byte) chromedp.Action {
+	return chromedp.ActionFunc(func(ctxt context.Context, h cdp.Executor) error {
+		box, err := boundingBox(ctxt, h, sel)
+		if err != nil {
+			return err
+		}
+		scale := s.scaleFor(box[2], box[3])
+		if err := (limits{pixels: s.budget}).checkPixels(box[2]*scale, box[3]*scale); err != nil {
+			return err
+		}
+		clip := &page.Viewport{X: box[0], Y: box[1], Width: box[2], Height: box[3], Scale: scale}
+		*res, err = page.CaptureScreenshot().WithClip(clip).Do(ctxt, h)
+		return err
+	})
+}
+
+// printPDF prints the page showing the svg to a pdf. The page size is the
+// size of the node showing the svg, converted to inches.
+func printPDF(pageURL *url.URL, size svgSize, s shot, res *[]byte) chromedp.Tasks {
+	sel := `#svg`
+	w, h := size.pixels()
+	return chromedp.Tasks{
+		emulation.SetDeviceMetricsOverride(int64(w), int64(h), 1, false),
+		chromedp.Navigate(pageURL.String()),
+		waitLoaded(),
+		fitViewport(sel, s),
+		chromedp.ActionFunc(func(ctxt context.Context, h cdp.Executor) error {
+			box, err := boundingBox(ctxt, h, sel)
+			if err != nil {
+				return err
+			}
+			*res, err = page.PrintToPDF().
+				WithPrintBackground(true).
+				WithPaperWidth((box[0]+box[2])/cssDPI).
+				WithPaperHeight((box[1]+box[3])/cssDPI).
+				WithMarginTop(0).
+				WithMarginBottom(0).
+				WithMarginLeft(0).
+				WithMarginRight(0).
+				WithPageRanges("1").
+				Do(ctxt, h)
+			return err
+		}),
+	}
+}
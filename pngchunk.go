@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// writeChunk writes a single png chunk including length and crc
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)))
+	copy(hdr[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(data)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	for _, b := range [][]byte{hdr[:], data, sum[:]} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pngChunk is a single chunk of a png file
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// ancillary reports whether the chunk can be dropped without changing the
+// image, see https://www.w3.org/TR/PNG/#5Chunk-naming-conventions
+func (c pngChunk) ancillary() bool {
+	return c.typ[0]&0x20 != 0
+}
+
+// readChunks splits a png file into its chunks without validating crcs
+func readChunks(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("not a png file")
+	}
+	var chunks []pngChunk
+	for p := data[len(pngSignature):]; len(p) > 0; {
+		if len(p) < 12 {
+			return nil, errors.New("truncated png chunk")
+		}
+		n := binary.BigEndian.Uint32(p[:4])
+		if uint64(n)+12 > uint64(len(p)) {
+			return nil, errors.New("truncated png chunk")
+		}
+		chunks = append(chunks, pngChunk{typ: string(p[4:8]), data: p[8 : 8+n]})
+		p = p[12+n:]
+	}
+	return chunks, nil
+}
+
+// writeChunks assembles a png file from its chunks
+func writeChunks(chunks []pngChunk) []byte {
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	for _, c := range chunks {
+		writeChunk(&buf, c.typ, c.data)
+	}
+	return buf.Bytes()
+}
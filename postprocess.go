@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"nearest":           imaging.NearestNeighbor,
+	"box":               imaging.Box,
+	"linear":            imaging.Linear,
+	"hermite":           imaging.Hermite,
+	"mitchellnetravali": imaging.MitchellNetravali,
+	"catmullrom":        imaging.CatmullRom,
+	"bspline":           imaging.BSpline,
+	"gaussian":          imaging.Gaussian,
+	"bartlett":          imaging.Bartlett,
+	"lanczos":           imaging.Lanczos,
+	"hann":              imaging.Hann,
+	"hamming":           imaging.Hamming,
+	"blackman":          imaging.Blackman,
+	"welch":             imaging.Welch,
+	"cosine":            imaging.Cosine,
+}
+
+// postOptions are applied in go to the png returned by chrome
+type postOptions struct {
+	width, height int    // resize target, 0 keeps the aspect ratio
+	mode          string // resize, fit, fill or crop
+	filter        imaging.ResampleFilter
+	rotate        float64 // degrees counter-clockwise
+	flipH, flipV  bool
+	grayscale     bool
+	blur          float64 // sigma
+	sharpen       float64 // sigma
+	brightness    float64 // percentage, -100 to 100
+	contrast      float64 // percentage, -100 to 100
+	trim          string  // alpha or color, see contentBounds
+	tolerance     int
+	padding       int
+	watermark     *watermark
+
+	// size optimizations, see parseOptimizeOptions
+	compression png.CompressionLevel
+	reencode    bool // compression was set explicitly
+	palette     bool // use a palette if there are at most 256 colors
+	colors      int  // quantize to this many colors
+	dither      bool
+	strip       bool // remove ancillary chunks
+}
+
+// empty reports whether the image itself is left unchanged
+func (o postOptions) empty() bool {
+	return o.width == 0 && o.height == 0 && o.rotate == 0 && !o.flipH && !o.flipV &&
+		!o.grayscale && o.blur == 0 && o.sharpen == 0 && o.brightness == 0 && o.contrast == 0 &&
+		o.trim == "" && o.padding == 0 && o.watermark == nil
+}
+
+// parsePostOptions reads the post-processing options from the query:
+// resize=WxH, mode, filter, rotate, flip=h|v|hv, grayscale, blur, sharpen,
+// brightness and contrast, plus the trim and optimize options
+func parsePostOptions(q url.Values) (postOptions, error) {
+	o := postOptions{mode: "resize", filter: imaging.Lanczos}
+	if s := q.Get("resize"); s != "" {
+		parts := strings.SplitN(strings.ToLower(s), "x", 2)
+		if len(parts) != 2 {
+			return o, fmt.Errorf("invalid resize '%s', expected WxH", s)
+		}
+		for i, p := range parts {
+			if p == "" {
+				continue
+			}
+			n, err := strconv.Atoi(p)
+			if err != nil || n < 0 {
+				return o, fmt.Errorf("invalid resize '%s', expected WxH", s)
+			}
+			if i == 0 {
+				o.width = n
+			} else {
+				o.height = n
+			}
+		}
+	}
+	if m := q.Get("mode"); m != "" {
+		switch m {
+		case "resize", "fit", "fill", "crop":
+			o.mode = m
+		default:
+			return o, fmt.Errorf("unsupported mode '%s'", m)
+		}
+		if m != "resize" && (o.width == 0 || o.height == 0) {
+			return o, fmt.Errorf("mode '%s' needs both width and height in resize", m)
+		}
+	}
+	if f := q.Get("filter"); f != "" {
+		filter, ok := resampleFilters[strings.ToLower(f)]
+		if !ok {
+			return o, fmt.Errorf("unsupported filter '%s'", f)
+		}
+		o.filter = filter
+	}
+	switch f := q.Get("flip"); f {
+	case "":
+	case "h":
+		o.flipH = true
+	case "v":
+		o.flipV = true
+	case "hv", "vh":
+		o.flipH, o.flipV = true, true
+	default:
+		return o, fmt.Errorf("invalid flip '%s', expected h, v or hv", f)
+	}
+	if g := q.Get("grayscale"); g != "" {
+		v, err := strconv.ParseBool(g)
+		if err != nil {
+			return o, fmt.Errorf("invalid grayscale '%s'", g)
+		}
+		o.grayscale = v
+	}
+	for _, p := range []struct {
+		name     string
+		v        *float64
+		min, max float64
+	}{
+		{"rotate", &o.rotate, -360, 360},
+		{"blur", &o.blur, 0, 100},
+		{"sharpen", &o.sharpen, 0, 100},
+		{"brightness", &o.brightness, -100, 100},
+		{"contrast", &o.contrast, -100, 100},
+	} {
+		s := q.Get(p.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < p.min || v > p.max {
+			return o, fmt.Errorf("invalid %s '%s', must be between %g and %g", p.name, s, p.min, p.max)
+		}
+		*p.v = v
+	}
+	if err := parseTrimOptions(q, &o); err != nil {
+		return o, err
+	}
+	return o, parseOptimizeOptions(q, &o)
+}
+
+// outputSize returns the size of a w x h image after apply. trim is ignored,
+// it only makes images smaller.
+func (o postOptions) outputSize(w, h float64) (float64, float64) {
+	switch {
+	case o.width > 0 && o.height > 0:
+		w, h = float64(o.width), float64(o.height)
+	case o.width > 0 && w > 0:
+		w, h = float64(o.width), h*float64(o.width)/w
+	case o.height > 0 && h > 0:
+		w, h = w*float64(o.height)/h, float64(o.height)
+	}
+	switch o.rotate {
+	case 0, 180, 360, -180, -360:
+	case 90, 270, -90, -270:
+		w, h = h, w
+	default:
+		sin, cos := math.Abs(math.Sin(o.rotate*math.Pi/180)), math.Abs(math.Cos(o.rotate*math.Pi/180))
+		w, h = w*cos+h*sin, w*sin+h*cos
+	}
+	return w + 2*float64(o.padding), h + 2*float64(o.padding)
+}
+
+// apply runs all operations in a fixed order: trim, resize, rotate, flip,
+// grayscale, brightness, contrast, blur, sharpen, padding and watermark
+func (o postOptions) apply(img image.Image) image.Image {
+	if o.trim != "" {
+		img = trimImage(img, o.trim, o.tolerance)
+	}
+	if o.width > 0 || o.height > 0 {
+		switch o.mode {
+		case "fit":
+			img = imaging.Fit(img, o.width, o.height, o.filter)
+		case "fill":
+			img = imaging.Fill(img, o.width, o.height, imaging.Center, o.filter)
+		case "crop":
+			img = imaging.CropCenter(img, o.width, o.height)
+		default:
+			img = imaging.Resize(img, o.width, o.height, o.filter)
+		}
+	}
+	switch o.rotate {
+	case 0, 360, -360:
+	case 90, -270:
+		img = imaging.Rotate90(img)
+	case 180, -180:
+		img = imaging.Rotate180(img)
+	case 270, -90:
+		img = imaging.Rotate270(img)
+	default:
+		img = imaging.Rotate(img, o.rotate, color.Transparent)
+	}
+	if o.flipH {
+		img = imaging.FlipH(img)
+	}
+	if o.flipV {
+		img = imaging.FlipV(img)
+	}
+	if o.grayscale {
+		img = imaging.Grayscale(img)
+	}
+	if o.brightness != 0 {
+		img = imaging.AdjustBrightness(img, o.brightness)
+	}
+	if o.contrast != 0 {
+		img = imaging.AdjustContrast(img, o.contrast)
+	}
+	if o.blur > 0 {
+		img = imaging.Blur(img, o.blur)
+	}
+	if o.sharpen > 0 {
+		img = imaging.Sharpen(img, o.sharpen)
+	}
+	if o.padding > 0 {
+		img = padImage(img, o.padding)
+	}
+	if o.watermark != nil {
+		img = o.watermark.apply(img)
+	}
+	return img
+}
+
+// postProcess applies the options to a png rendered by chrome
+func postProcess(data []byte, o postOptions) ([]byte, error) {
+	switch {
+	case o.empty() && !o.optimized():
+		return data, nil
+	case o.empty() && !o.reencode && !o.palette && o.colors == 0:
+		return stripChunks(data)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img = o.apply(img)
+	if o.colors > 0 {
+		img = quantize(img, o.colors, o.dither)
+	} else if o.palette {
+		if p, ok := toPalette(img); ok {
+			img = p
+		}
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: o.compression}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	// lossless optimization should never make things worse
+	if o.empty() && !o.reencode && o.colors == 0 && buf.Len() > len(data) {
+		if o.strip {
+			return stripChunks(data)
+		}
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+var tiffCompressions = map[string]tiff.CompressionType{
+	"none":    tiff.Uncompressed,
+	"deflate": tiff.Deflate,
+}
+
+// rasterFormat re-encodes the png rendered by chrome
+type rasterFormat struct {
+	contentType string
+	encode      func(img image.Image, q url.Values, dpi float64) ([]byte, error)
+}
+
+var rasterFormats = map[string]rasterFormat{
+	"tiff": {"image/tiff", encodeTIFF},
+	"bmp":  {"image/bmp", encodeBMP},
+}
+
+// parseTIFFCompression reads the tiff-compression parameter (none or
+// deflate, the default)
+func parseTIFFCompression(q url.Values) (tiff.CompressionType, error) {
+	c := q.Get("tiff-compression")
+	if c == "" {
+		return tiff.Deflate, nil
+	}
+	ct, ok := tiffCompressions[c]
+	if !ok {
+		return 0, fmt.Errorf("unsupported tiff-compression '%s', expected none or deflate", c)
+	}
+	return ct, nil
+}
+
+// encodeTIFF encodes img as tiff with the compression of the
+// tiff-compression parameter and the given resolution
+func encodeTIFF(img image.Image, q url.Values, dpi float64) ([]byte, error) {
+	ct, err := parseTIFFCompression(q)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tiff.Encode(&buf, img, &tiff.Options{Compression: ct}); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	if dpi > 0 {
+		if err := setTIFFResolution(data, dpi); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// setTIFFResolution overwrites the XResolution and YResolution tags of the
+// first IFD of a little endian tiff. The tiff package always writes 72 dpi.
+func setTIFFResolution(data []byte, dpi float64) error {
+	le := binary.LittleEndian
+	if len(data) < 8 || string(data[:4]) != "II*\x00" {
+		return errors.New("not a little endian tiff")
+	}
+	ifd := int(le.Uint32(data[4:8]))
+	if ifd+2 > len(data) {
+		return errors.New("truncated tiff")
+	}
+	n := int(le.Uint16(data[ifd:]))
+	num, den := uint32(math.Round(dpi*100)), uint32(100)
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > len(data) {
+			return errors.New("truncated tiff")
+		}
+		tag := le.Uint16(data[e:])
+		if tag != 282 && tag != 283 { // XResolution, YResolution
+			continue
+		}
+		off := int(le.Uint32(data[e+8:]))
+		if off+8 > len(data) {
+			return errors.New("truncated tiff")
+		}
+		le.PutUint32(data[off:], num)
+		le.PutUint32(data[off+4:], den)
+	}
+	return nil
+}
+
+// encodeBMP encodes img as bmp with the given resolution
+func encodeBMP(img image.Image, q url.Values, dpi float64) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bmp.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	if dpi > 0 && len(data) >= 46 {
+		ppm := uint32(math.Round(dpi / 0.0254))
+		binary.LittleEndian.PutUint32(data[38:], ppm)
+		binary.LittleEndian.PutUint32(data[42:], ppm)
+	}
+	return data, nil
+}
+
+// rasterHandler renders the svg like mainHandler and re-encodes the result
+// in another raster format
+func rasterHandler(rd *renderer, cfg *config, format string) http.HandlerFunc {
+	f := rasterFormats[format]
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, size, s, status, err := readSVG(r, cfg)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, status)
+			return
+		}
+		post, err := cfg.postOptions(r, size, s)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		dpi, err := parseDPI(r.URL.Query())
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		if format == "tiff" {
+			if _, err := parseTIFFCompression(r.URL.Query()); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusBadRequest)
+				return
+			}
+		}
+		mode, err := parseRendererMode(r.URL.Query())
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		res, used, err := rd.renderWith(r.Context(), mode, body, size, s)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Renderer", used)
+		out, err := postProcess(res, post)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		img, err := png.Decode(bytes.NewReader(out))
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		data, err := f.encode(img, r.URL.Query(), dpi)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", f.contentType)
+		w.Write(data)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/chromedp"
+	"github.com/pkg/errors"
+)
+
+// renderer renders svgs by letting one of the chrome instances load them
+// from this service
+type renderer struct {
+	images  *imageMap
+	chromes chan *chromedp.CDP
+	selfURL string
+
+	// how long to wait for a chrome instance before falling back to the
+	// go renderer, 0 disables the automatic fallback
+	fallbackWait time.Duration
+
+	mu     sync.Mutex
+	chrome string // product reported by chrome, see recordVersion
+}
+
+func NewRenderer(images *imageMap, chromes chan *chromedp.CDP, selfURL string, fallbackWait time.Duration) *renderer {
+	return &renderer{
+		images:       images,
+		chromes:      chromes,
+		selfURL:      selfURL,
+		fallbackWait: fallbackWait,
+	}
+}
+
+// names of the renderers, reported in the X-Renderer header
+const (
+	chromeRenderer = "chrome"
+	goRenderer     = "go"
+)
+
+// shot is a single screenshot of a page showing the svg
+type shot struct {
+	params url.Values // parameters of the page, see htmlHandler
+	scale  float64    // device pixels per css pixel, 1 if unset
+	fit    float64    // if set, scale so the larger side has fit pixels
+	budget float64    // pixels of the captured image, 0 is unlimited
+}
+
+// scaleFor returns the device pixels per css pixel of a capture of w x h css
+// pixels
+func (s shot) scaleFor(w, h float64) float64 {
+	scale := s.scale
+	if s.fit > 0 {
+		scale = s.fit / math.Max(w, h)
+	}
+	if scale <= 0 {
+		scale = 1
+	}
+	return scale
+}
+
+// imageSize returns the size in device pixels of the shot of an svg of the
+// given size
+func (s shot) imageSize(size svgSize) (float64, float64) {
+	scale := s.scaleFor(size.Width, size.Height)
+	return math.Ceil(size.Width * scale), math.Ceil(size.Height * scale)
+}
+
+// render makes the svg available to chrome and takes all shots on the same
+// chrome instance.
+func (rd *renderer) render(ctx context.Context, svg []byte, size svgSize, shots ...shot) ([][]byte, error) {
+	c, err := rd.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { rd.chromes <- c }()
+	return rd.renderOn(ctx, c, svg, size, shots...)
+}
+
+// acquire takes a chrome instance from the pool, waiting until ctx is done
+func (rd *renderer) acquire(ctx context.Context) (*chromedp.CDP, error) {
+	select {
+	case c := <-rd.chromes:
+		return c, nil
+	case <-ctx.Done():
+		return nil, newError(http.StatusServiceUnavailable, codeChromeUnavailable,
+			errors.Wrap(ctx.Err(), "no chrome instance available"))
+	}
+}
+
+// renderOn takes the shots on the given chrome instance
+func (rd *renderer) renderOn(ctx context.Context, c *chromedp.CDP, svg []byte, size svgSize, shots ...shot) ([][]byte, error) {
+	name, remove := rd.serve(svg)
+	defer remove()
+
+	res := make([][]byte, len(shots))
+	for i, s := range shots {
+		pageURL, err := rd.pageURL(name, s)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Run(ctx, fetchImages(pageURL, size, s, &res[i])); err != nil {
+			reset(c)
+			return nil, chromeError(ctx, err)
+		}
+	}
+	rd.recordVersion(ctx, c)
+	return res, nil
+}
+
+// renderPDF prints the page showing the svg to a pdf with a single page of
+// the svg's size
+func (rd *renderer) renderPDF(ctx context.Context, svg []byte, size svgSize, s shot) ([]byte, error) {
+	c, err := rd.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { rd.chromes <- c }()
+	name, remove := rd.serve(svg)
+	defer remove()
+
+	pageURL, err := rd.pageURL(name, s)
+	if err != nil {
+		return nil, err
+	}
+	var res []byte
+	if err := c.Run(ctx, printPDF(pageURL, size, s, &res)); err != nil {
+		reset(c)
+		return nil, chromeError(ctx, err)
+	}
+	return res, nil
+}
+
+// serve makes the svg available to chrome under the returned name until
+// remove is called
+func (rd *renderer) serve(svg []byte) (name string, remove func()) {
+	h := sha256.New()
+	h.Write([]byte(time.Now().UTC().String()))
+	h.Write(svg)
+	name = fmt.Sprintf("%x.svg", h.Sum([]byte{}))
+	rd.images.Add(name, svg)
+	return name, func() { rd.images.Remove(name) }
+}
+
+// pageURL is the url of the page showing the served svg for the shot
+func (rd *renderer) pageURL(name string, s shot) (*url.URL, error) {
+	return url.Parse(fmt.Sprintf("%s%s?%s", rd.selfURL, name, s.params.Encode()))
+}
+
+// how long resetting a tab may take
+const resetTimeout = 5 * time.Second
+
+// reset stops a page that failed to render, e.g. because the request timed
+// out, and navigates to about:blank before the instance returns to the pool,
+// so a hung page does not affect the next render
+func reset(c *chromedp.CDP) {
+	ctx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+	defer cancel()
+	if err := c.Run(ctx, chromedp.Tasks{chromedp.Stop(), chromedp.Navigate("about:blank")}); err != nil {
+		logrus.Warnf("could not reset chrome tab: %s", err)
+	}
+}
+
+// renderWith renders a single shot with the renderer selected by mode: chrome,
+// go or auto. auto uses chrome, but falls back to the go renderer for svgs it
+// supports if no chrome instance becomes available within the fallback wait
+// or chrome is unavailable or times out. Other chrome errors, e.g. an svg that
+// fails to load, are returned. The name of the renderer used is returned.
+func (rd *renderer) renderWith(ctx context.Context, mode string, svg []byte, size svgSize, s shot) ([]byte, string, error) {
+	if mode == goRenderer {
+		d, err := newGoDrawing(svg, size, s)
+		if err != nil {
+			return nil, goRenderer, err
+		}
+		res, err := d.png(ctx)
+		return res, goRenderer, err
+	}
+	var d *goDrawing
+	if mode != chromeRenderer && rd.fallbackWait > 0 {
+		d, _ = newGoDrawing(svg, size, s)
+	}
+	if d == nil {
+		res, err := rd.render(ctx, svg, size, s)
+		if err != nil {
+			return nil, chromeRenderer, err
+		}
+		return res[0], chromeRenderer, nil
+	}
+
+	select {
+	case c := <-rd.chromes:
+		res, err := rd.renderOn(ctx, c, svg, size, s)
+		rd.chromes <- c
+		if err == nil {
+			return res[0], chromeRenderer, nil
+		}
+		if code := classify(err, http.StatusInternalServerError).Code; ctx.Err() != nil ||
+			code != codeChromeUnavailable && code != codeRenderTimeout {
+			return nil, chromeRenderer, err
+		}
+		logrus.Warnf("chrome failed, falling back to the go renderer: %s", err)
+	case <-time.After(rd.fallbackWait):
+		logrus.Debugf("no chrome available after %s, using the go renderer", rd.fallbackWait)
+	case <-ctx.Done():
+		return nil, chromeRenderer, newError(http.StatusServiceUnavailable, codeChromeUnavailable,
+			errors.Wrap(ctx.Err(), "no chrome instance available"))
+	}
+	res, err := d.png(ctx)
+	return res, goRenderer, err
+}
+
+// parseRendererMode reads the renderer parameter: auto (the default), chrome
+// or go
+func parseRendererMode(q url.Values) (string, error) {
+	switch m := q.Get("renderer"); m {
+	case "", "auto":
+		return "auto", nil
+	case chromeRenderer, goRenderer:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unsupported renderer '%s', expected auto, chrome or go", m)
+	}
+}
+
+// version returns the product string of chrome, e.g.
+// HeadlessChrome/75.0.3770.100, or "" if nothing was rendered with chrome yet
+func (rd *renderer) version() string {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	return rd.chrome
+}
+
+// recordVersion queries the product string of chrome on c after a render.
+// All instances of the pool are assumed to run the same version, so it is
+// only queried once.
+func (rd *renderer) recordVersion(ctx context.Context, c *chromedp.CDP) {
+	if rd.version() != "" {
+		return
+	}
+	err := c.Run(ctx, chromedp.ActionFunc(func(ctxt context.Context, h cdp.Executor) error {
+		_, product, _, _, _, err := browser.GetVersion().Do(ctxt, h)
+		if err == nil {
+			rd.mu.Lock()
+			rd.chrome = product
+			rd.mu.Unlock()
+		}
+		return err
+	}))
+	if err != nil {
+		logrus.Warnf("could not query the chrome version: %s", err)
+	}
+}
+
+// pageParams returns the parameters of the page showing the whole svg
+func pageParams(size svgSize) url.Values {
+	params := url.Values{}
+	params.Set("w", strconv.FormatFloat(size.Width, 'g', -1, 64))
+	params.Set("h", strconv.FormatFloat(size.Height, 'g', -1, 64))
+	return params
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// s3Backend stores the svgs as {prefix}{id}.svg objects in a bucket of an
+// S3-compatible service, using path-style urls and AWS signature version 4
+type s3Backend struct {
+	endpoint  *url.URL // e.g. https://s3.eu-central-1.amazonaws.com
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func NewS3Backend(endpoint, bucket, prefix, region, accessKey, secretKey string) (*s3Backend, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid s3 endpoint")
+	}
+	if u.Scheme == "" || u.Host == "" || bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket are required")
+	}
+	return &s3Backend{
+		endpoint:  u,
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// signV4 signs req for the s3 service, payloadHash is the hex sha256 of the
+// body
+func signV4(req *http.Request, payloadHash, region, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+
+	// spaces are encoded as %20, not +
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{"host": req.URL.Host, "x-amz-content-sha256": payloadHash, "x-amz-date": amzDate}
+	sort.Strings(headers)
+	var canonicalHeaders bytes.Buffer
+	for _, h := range headers {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, values[h])
+	}
+	signedHeaders := strings.Join(headers, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		query,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// do sends a signed request for the object key, or the bucket if key is empty
+func (b *s3Backend) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.bucket + "/" + key
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "image/svg+xml")
+	}
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), b.region, b.accessKey, b.secretKey, time.Now())
+	return b.client.Do(req)
+}
+
+// s3Error reads the error of an unexpected response
+func s3Error(resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("s3 %s %s: %s %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, bytes.TrimSpace(msg))
+}
+
+func (b *s3Backend) Get(id string) ([]byte, time.Time, error) {
+	resp, err := b.do(http.MethodGet, b.prefix+id+".svg", nil, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, time.Time{}, errNotStored
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, s3Error(resp)
+	}
+	stored, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "invalid Last-Modified")
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, stored, err
+}
+
+func (b *s3Backend) Put(id string, data []byte) error {
+	resp, err := b.do(http.MethodPut, b.prefix+id+".svg", nil, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (b *s3Backend) Delete(id string) error {
+	resp, err := b.do(http.MethodDelete, b.prefix+id+".svg", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// List pages through ListObjectsV2
+func (b *s3Backend) List() (map[string]time.Time, error) {
+	res := map[string]time.Time{}
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {b.prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := b.do(http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var list struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse s3 object list")
+		}
+		for _, c := range list.Contents {
+			id := strings.TrimSuffix(strings.TrimPrefix(c.Key, b.prefix), ".svg")
+			if svgIDRE.MatchString(id) {
+				res[id] = c.LastModified
+			}
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return res, nil
+		}
+		token = list.NextContinuationToken
+	}
+}
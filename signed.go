@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// signer checks signed render urls: GET /v1/png/{signature}?svg=...&...
+// The signature is the unpadded base64url HMAC-SHA256 of the sorted, encoded
+// query (url.Values.Encode), so any change of a parameter invalidates it.
+type signer struct {
+	secret []byte
+	maxAge time.Duration // of the Cache-Control header
+}
+
+// sign returns the signature of the query
+func (sg *signer) sign(q url.Values) string {
+	mac := hmac.New(sha256.New, sg.secret)
+	mac.Write([]byte(q.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the signature and the optional expires parameter (unix
+// seconds) and returns how long the response may be cached
+func (sg *signer) verify(sig string, q url.Values) (time.Duration, error) {
+	if !hmac.Equal([]byte(sig), []byte(sg.sign(q))) {
+		return 0, newError(http.StatusForbidden, codeForbidden, errors.New("invalid signature"))
+	}
+	maxAge := sg.maxAge
+	if s := q.Get("expires"); s != "" {
+		secs, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, newError(http.StatusBadRequest, codeInvalidRequest, fmt.Errorf("invalid expires '%s'", s))
+		}
+		left := time.Until(time.Unix(secs, 0))
+		if left <= 0 {
+			return 0, newError(http.StatusForbidden, codeForbidden, errors.New("url expired"))
+		}
+		if left < maxAge {
+			maxAge = left
+		}
+	}
+	return maxAge, nil
+}
+
+// signedParams returns the render parameters of a signed url: all but svg and
+// expires, with w and h as short forms of width and height. The automatic
+// fallback to the go renderer is disabled, so the bytes behind an ETag do not
+// depend on which renderer was available.
+func signedParams(q url.Values) url.Values {
+	params := url.Values{}
+	for k, v := range q {
+		switch k {
+		case "svg", "expires":
+		case "w":
+			params["width"] = v
+		case "h":
+			params["height"] = v
+		default:
+			params[k] = v
+		}
+	}
+	if m := params.Get("renderer"); m == "" || m == "auto" {
+		params.Set("renderer", chromeRenderer)
+	}
+	return params
+}
+
+// cacheWriter drops the caching headers of error responses so they are not
+// cached by a CDN
+type cacheWriter struct {
+	http.ResponseWriter
+}
+
+func (w cacheWriter) WriteHeader(status int) {
+	if status != http.StatusOK {
+		h := w.Header()
+		h.Del("ETag")
+		h.Set("Cache-Control", "no-store")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// signedHandler renders the svg of a signed url with the png handler. svg is
+// the id of a stored svg, the name of a template or a url, fetched as for
+// src. The response has a strong ETag derived from the parameters and the
+// svg and supports conditional requests.
+func signedHandler(sg *signer, templates *templateMap, rd *renderer, cfg *config) http.HandlerFunc {
+	png := mainHandler(rd, cfg)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		maxAge, err := sg.verify(strings.TrimPrefix(r.URL.Path, "/v1/png/"), q)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusForbidden)
+			return
+		}
+
+		var svg []byte
+		switch id := q.Get("svg"); {
+		case id == "":
+			err = newError(http.StatusBadRequest, codeInvalidRequest, errors.New("svg is required"))
+		case strings.HasPrefix(id, "http://") || strings.HasPrefix(id, "https://"):
+			if cfg.fetcher == nil {
+				err = newError(http.StatusForbidden, codeAssetBlocked, errors.New("fetching svgs is disabled"))
+				break
+			}
+			svg, err = cfg.fetcher.fetch(r.Context(), id)
+		case svgIDRE.MatchString(id):
+			svg, err = cfg.storedSVG(id)
+		default:
+			var ok bool
+			if svg, ok = templates.Get(id); !ok {
+				err = newError(http.StatusNotFound, codeNotFound, fmt.Errorf("svg '%s' not found", id))
+			}
+		}
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		params := signedParams(q)
+		h := sha256.New()
+		h.Write([]byte(params.Encode()))
+		h.Write([]byte{0})
+		h.Write(svg)
+		etag := fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+		if match := r.Header.Get("If-None-Match"); match != "" {
+			for _, m := range strings.Split(match, ",") {
+				if m = strings.TrimSpace(m); m == etag || m == "*" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+		}
+
+		pr := r.WithContext(r.Context())
+		pr.URL = &url.URL{Path: "/v1/png", RawQuery: params.Encode()}
+		pr.Header = http.Header{}
+		pr.Body = ioutil.NopCloser(bytes.NewReader(svg))
+		png(cacheWriter{w}, pr)
+	}
+}
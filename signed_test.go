@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestSignerVerify(t *testing.T) {
+	sg := &signer{secret: []byte("secret"), maxAge: time.Hour}
+	other := &signer{secret: []byte("other"), maxAge: time.Hour}
+	unix := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).Unix(), 10)
+	}
+	tests := []struct {
+		name   string
+		signed url.Values // the query the signature is computed for
+		q      url.Values // the query of the request, signed if nil
+		by     *signer
+		status int // of the error, 0 if valid
+		maxAge time.Duration
+	}{
+		{name: "valid", signed: url.Values{"svg": {"logo"}, "w": {"200"}}, maxAge: time.Hour},
+		{name: "order does not matter", signed: url.Values{"w": {"200"}, "svg": {"logo"}, "dpi": {"300"}}, maxAge: time.Hour},
+		{name: "other secret", signed: url.Values{"svg": {"logo"}}, by: other, status: http.StatusForbidden},
+		{name: "changed parameter", signed: url.Values{"svg": {"logo"}, "w": {"200"}},
+			q: url.Values{"svg": {"logo"}, "w": {"2000"}}, status: http.StatusForbidden},
+		{name: "added parameter", signed: url.Values{"svg": {"logo"}},
+			q: url.Values{"svg": {"logo"}, "scale": {"4"}}, status: http.StatusForbidden},
+		{name: "removed expires", signed: url.Values{"svg": {"logo"}, "expires": {unix(time.Minute)}},
+			q: url.Values{"svg": {"logo"}}, status: http.StatusForbidden},
+		{name: "expires later", signed: url.Values{"svg": {"logo"}, "expires": {unix(2 * time.Hour)}}, maxAge: time.Hour},
+		{name: "expires sooner", signed: url.Values{"svg": {"logo"}, "expires": {unix(time.Minute)}}, maxAge: time.Minute},
+		{name: "expired", signed: url.Values{"svg": {"logo"}, "expires": {unix(-time.Minute)}}, status: http.StatusForbidden},
+		{name: "invalid expires", signed: url.Values{"svg": {"logo"}, "expires": {"tomorrow"}}, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		by, q := tt.by, tt.q
+		if by == nil {
+			by = sg
+		}
+		if q == nil {
+			q = tt.signed
+		}
+		maxAge, err := sg.verify(by.sign(tt.signed), q)
+		if tt.status != 0 {
+			ae, ok := errors.Cause(err).(*apiError)
+			if !ok || ae.status != tt.status {
+				t.Errorf("%s: expected status %d, got %v", tt.name, tt.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		// expires is in whole seconds
+		if d := tt.maxAge - maxAge; d < 0 || d > 2*time.Second {
+			t.Errorf("%s: got max age %s, expected %s", tt.name, maxAge, tt.maxAge)
+		}
+	}
+}
+
+func TestSignedParams(t *testing.T) {
+	tests := []struct {
+		q    url.Values
+		want url.Values
+	}{
+		{
+			q:    url.Values{"svg": {"logo"}, "expires": {"1"}, "w": {"200"}, "h": {"100"}},
+			want: url.Values{"width": {"200"}, "height": {"100"}, "renderer": {"chrome"}},
+		},
+		{
+			q:    url.Values{"svg": {"logo"}, "dpi": {"300"}, "renderer": {"auto"}},
+			want: url.Values{"dpi": {"300"}, "renderer": {"chrome"}},
+		},
+		{
+			q:    url.Values{"svg": {"logo"}, "renderer": {"go"}},
+			want: url.Values{"renderer": {"go"}},
+		},
+	}
+	for _, tt := range tests {
+		if got := signedParams(tt.q).Encode(); got != tt.want.Encode() {
+			t.Errorf("signedParams(%s): got %s, expected %s", tt.q.Encode(), got, tt.want.Encode())
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// svgSize is the intrinsic size of an SVG in CSS pixels
+type svgSize struct {
+	Width  float64
+	Height float64
+}
+
+func (s svgSize) String() string {
+	return fmt.Sprintf("%gx%g", s.Width, s.Height)
+}
+
+// pixels returns the size rounded up to whole device pixels
+func (s svgSize) pixels() (int, int) {
+	return int(math.Ceil(s.Width)), int(math.Ceil(s.Height))
+}
+
+// cssDPI is the number of CSS pixels per inch
+const cssDPI = 96
+
+// CSS pixels per unit, see https://www.w3.org/TR/css-values-3/#absolute-lengths
+var unitFactors = map[string]float64{
+	"":   1,
+	"px": 1,
+	"pt": 96.0 / 72.0,
+	"pc": 96.0 / 6.0,
+	"mm": 96.0 / 25.4,
+	"cm": 96.0 / 2.54,
+	"in": 96,
+	"em": 16, // default font size of the rendering page
+	"ex": 8,
+}
+
+// parseLength converts an SVG length attribute to CSS pixels. ok is false for
+// missing, relative (%) or otherwise unusable lengths.
+func parseLength(s string) (px float64, ok bool, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "auto" || strings.HasSuffix(s, "%") {
+		return 0, false, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != '-' && r != '+' && r != 'e' && r != 'E'
+	})
+	// a trailing "em"/"ex" starts with 'e' and is swallowed by the number scan
+	if strings.HasSuffix(s, "em") || strings.HasSuffix(s, "ex") {
+		i = len(s) - 2
+	}
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = s[:i], strings.ToLower(strings.TrimSpace(s[i:]))
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "invalid length '%s'", s)
+	}
+	f, known := unitFactors[unit]
+	if !known {
+		return 0, false, fmt.Errorf("unsupported unit '%s' in length '%s'", unit, s)
+	}
+	if v <= 0 {
+		return 0, false, nil
+	}
+	return v * f, true, nil
+}
+
+// parseViewBox returns width and height of a viewBox attribute
+func parseViewBox(s string) (float64, float64, bool) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	if len(fields) != 4 {
+		return 0, 0, false
+	}
+	w, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || w <= 0 {
+		return 0, 0, false
+	}
+	h, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil || h <= 0 {
+		return 0, 0, false
+	}
+	return w, h, true
+}
+
+// intrinsicSize determines the size an SVG should be rendered at from the
+// width, height and viewBox of its root element. Missing dimensions are
+// derived from the viewBox aspect ratio or taken from def.
+func intrinsicSize(data []byte, def svgSize) (svgSize, error) {
+	root, err := rootElement(data)
+	if err != nil {
+		return svgSize{}, err
+	}
+	w, hasW, err := parseLength(attr(root, "width"))
+	if err != nil {
+		return svgSize{}, err
+	}
+	h, hasH, err := parseLength(attr(root, "height"))
+	if err != nil {
+		return svgSize{}, err
+	}
+	vbW, vbH, hasVB := parseViewBox(attr(root, "viewBox"))
+
+	switch {
+	case hasW && hasH:
+	case hasW && hasVB:
+		h = w * vbH / vbW
+	case hasH && hasVB:
+		w = h * vbW / vbH
+	case hasVB:
+		w, h = vbW, vbH
+	default:
+		if !hasW {
+			w = def.Width
+		}
+		if !hasH {
+			h = def.Height
+		}
+	}
+	return svgSize{Width: w, Height: h}, nil
+}
+
+// parseDPI reads the dpi parameter. 0 means it was not set.
+func parseDPI(q url.Values) (float64, error) {
+	s := q.Get("dpi")
+	if s == "" {
+		return 0, nil
+	}
+	dpi, err := strconv.ParseFloat(s, 64)
+	if err != nil || dpi < 1 || dpi > 10000 {
+		return 0, fmt.Errorf("invalid dpi '%s', must be between 1 and 10000", s)
+	}
+	return dpi, nil
+}
+
+// outputSize applies the width and height parameters to the size of an svg.
+// They accept the units of parseLength, e.g. width=85mm. If only one is
+// given the aspect ratio is kept.
+func outputSize(q url.Values, size svgSize) (svgSize, error) {
+	var lengths [2]float64
+	for i, name := range []string{"width", "height"} {
+		s := q.Get(name)
+		if s == "" {
+			continue
+		}
+		v, ok, err := parseLength(s)
+		if err != nil {
+			return size, err
+		}
+		if !ok {
+			return size, fmt.Errorf("invalid %s '%s'", name, s)
+		}
+		lengths[i] = v
+	}
+	w, h := lengths[0], lengths[1]
+	switch {
+	case w > 0 && h > 0:
+		return svgSize{Width: w, Height: h}, nil
+	case w > 0:
+		return svgSize{Width: w, Height: w * size.Height / size.Width}, nil
+	case h > 0:
+		return svgSize{Width: h * size.Width / size.Height, Height: h}, nil
+	}
+	return size, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// elements that never render anything on their own
+var nonRendering = map[string]bool{
+	"defs":     true,
+	"style":    true,
+	"script":   true,
+	"title":    true,
+	"desc":     true,
+	"metadata": true,
+}
+
+// spriteIDs returns the ids of all <symbol> elements of an svg sprite. If
+// there are no symbols, the ids of the top-level elements are returned.
+func spriteIDs(data []byte) ([]string, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	var symbols, topLevel []string
+	depth := 0
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse svg")
+		}
+		switch se := t.(type) {
+		case xml.StartElement:
+			depth++
+			id := attr(se, "id")
+			if id == "" {
+				continue
+			}
+			if se.Name.Local == "symbol" {
+				symbols = append(symbols, id)
+			} else if depth == 2 && !nonRendering[se.Name.Local] {
+				topLevel = append(topLevel, id)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if len(symbols) > 0 {
+		return symbols, nil
+	}
+	if len(topLevel) > 0 {
+		return topLevel, nil
+	}
+	return nil, errors.New("svg contains no symbols or top-level elements with an id")
+}
+
+// zipFileName makes an element id safe to use as a file name in a zip
+func zipFileName(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, id)
+}
+
+func writeZip(w io.Writer, names []string, files [][]byte) error {
+	zw := zip.NewWriter(w)
+	for i, name := range names {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(files[i]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// upper bound of symbols rendered for a single request
+const maxSymbols = 200
+
+// spriteHandler renders every symbol of an svg sprite to a separate png and
+// returns them as a zip named by id. Each symbol counts as an image of the
+// size of the whole svg against the total pixel budgets.
+func spriteHandler(rd *renderer, cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, size, s, status, err := readSVG(r, cfg)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, status)
+			return
+		}
+		ids, err := spriteIDs(body)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		if len(ids) > maxSymbols {
+			err = errors.Errorf("svg has %d symbols, at most %d are allowed", len(ids), maxSymbols)
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		post, err := cfg.postOptions(r, size, s)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		pw, ph := post.outputSize(s.imageSize(size))
+		if err := cfg.checkTotal(r, float64(len(ids))*pw*ph); err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusUnprocessableEntity)
+			return
+		}
+
+		meta, status, err := requestMetadata(r)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, status)
+			return
+		}
+
+		shots := make([]shot, len(ids))
+		names := make([]string, len(ids))
+		for i, id := range ids {
+			shots[i] = shot{params: pageParams(size), scale: s.scale, budget: s.budget}
+			shots[i].params.Set("el", id)
+			names[i] = zipFileName(id) + ".png"
+		}
+		res, err := rd.render(r.Context(), body, size, shots...)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		meta = meta.renderedBy(rd, chromeRenderer)
+		before, after := 0, 0
+		for i := range res {
+			before += len(res[i])
+			if res[i], err = postProcess(res[i], post); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			after += len(res[i])
+			if res[i], err = meta.embed(res[i], body); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+		}
+		setBytesSaved(w, post, before, after)
+
+		var buf bytes.Buffer
+		if err := writeZip(&buf, names, res); err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="sprite.zip"`)
+		w.Write(buf.Bytes())
+	}
+}
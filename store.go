@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// errNotStored is returned by backends for unknown ids
+var errNotStored = errors.New("svg not stored")
+
+// svgBackend persists the svgs of the svgStore
+type svgBackend interface {
+	// Get returns the svg and when it was stored
+	Get(id string) ([]byte, time.Time, error)
+	// Put stores the svg, replacing an existing one
+	Put(id string, data []byte) error
+	Delete(id string) error
+	// List returns the ids with the time they were stored
+	List() (map[string]time.Time, error)
+}
+
+// ids are the sha256 of the svg
+var svgIDRE = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// svgStore keeps uploaded svgs so they can be rendered by id. Svgs expire
+// ttl after they were last uploaded, 0 keeps them forever.
+type svgStore struct {
+	backend svgBackend
+	ttl     time.Duration
+}
+
+func NewSVGStore(backend svgBackend, ttl time.Duration) *svgStore {
+	return &svgStore{backend: backend, ttl: ttl}
+}
+
+// Put stores the svg and returns its id
+func (st *svgStore) Put(data []byte) (string, error) {
+	id := fmt.Sprintf("%x", sha256.Sum256(data))
+	return id, st.backend.Put(id, data)
+}
+
+// Get returns a stored svg, a not_found error for unknown or expired ids
+func (st *svgStore) Get(id string) ([]byte, error) {
+	notFound := newError(http.StatusNotFound, codeNotFound, fmt.Errorf("svg '%s' not found", id))
+	if !svgIDRE.MatchString(id) {
+		return nil, notFound
+	}
+	data, stored, err := st.backend.Get(id)
+	if err == errNotStored || err == nil && st.expired(stored) {
+		return nil, notFound
+	}
+	return data, err
+}
+
+func (st *svgStore) expired(stored time.Time) bool {
+	return st.ttl > 0 && time.Since(stored) > st.ttl
+}
+
+// gc deletes all expired svgs
+func (st *svgStore) gc() error {
+	if st.ttl <= 0 {
+		return nil
+	}
+	ids, err := st.backend.List()
+	if err != nil {
+		return err
+	}
+	n := 0
+	for id, stored := range ids {
+		if !st.expired(stored) {
+			continue
+		}
+		if err := st.backend.Delete(id); err != nil && err != errNotStored {
+			return err
+		}
+		n++
+	}
+	if n > 0 {
+		logrus.Debugf("deleted %d expired svgs", n)
+	}
+	return nil
+}
+
+// RunGC runs gc every interval
+func (st *svgStore) RunGC(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := st.gc(); err != nil {
+			logrus.Warnf("svg store gc failed: %s", err)
+		}
+	}
+}
+
+// memoryBackend keeps the svgs in memory, they are lost on restart
+type memoryBackend struct {
+	sync.RWMutex
+	m       map[string]memorySVG
+	size    int64 // bytes of all svgs
+	maxSize int64 // 0 disables the limit
+}
+
+type memorySVG struct {
+	data   []byte
+	stored time.Time
+}
+
+func NewMemoryBackend(maxSize int64) *memoryBackend {
+	return &memoryBackend{m: map[string]memorySVG{}, maxSize: maxSize}
+}
+
+func (b *memoryBackend) Get(id string) ([]byte, time.Time, error) {
+	b.RLock()
+	defer b.RUnlock()
+	e, ok := b.m[id]
+	if !ok {
+		return nil, time.Time{}, errNotStored
+	}
+	return e.data, e.stored, nil
+}
+
+// Put fails with 507 if the svg would exceed the maximum size of the store
+func (b *memoryBackend) Put(id string, data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	size := b.size - int64(len(b.m[id].data)) + int64(len(data))
+	if b.maxSize > 0 && size > b.maxSize {
+		return &limitError{
+			status: http.StatusInsufficientStorage,
+			Reason: fmt.Sprintf("the svg store is full, it holds at most %d bytes", b.maxSize),
+			Limit:  float64(b.maxSize),
+			Actual: float64(size),
+		}
+	}
+	b.m[id] = memorySVG{data: data, stored: time.Now()}
+	b.size = size
+	return nil
+}
+
+func (b *memoryBackend) Delete(id string) error {
+	b.Lock()
+	defer b.Unlock()
+	e, ok := b.m[id]
+	if !ok {
+		return errNotStored
+	}
+	b.size -= int64(len(e.data))
+	delete(b.m, id)
+	return nil
+}
+
+func (b *memoryBackend) List() (map[string]time.Time, error) {
+	b.RLock()
+	defer b.RUnlock()
+	res := make(map[string]time.Time, len(b.m))
+	for id, e := range b.m {
+		res[id] = e.stored
+	}
+	return res, nil
+}
+
+// dirBackend stores the svgs as {id}.svg files in a directory, using the
+// modification time as the time they were stored
+type dirBackend struct {
+	dir string
+}
+
+func NewDirBackend(dir string) (*dirBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirBackend{dir: dir}, nil
+}
+
+func (b *dirBackend) path(id string) string {
+	return filepath.Join(b.dir, id+".svg")
+}
+
+func (b *dirBackend) Get(id string) ([]byte, time.Time, error) {
+	f, err := os.Open(b.path(id))
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, errNotStored
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := ioutil.ReadAll(f)
+	return data, fi.ModTime(), err
+}
+
+// Put writes to a temporary file first so readers never see partial svgs
+func (b *dirBackend) Put(id string, data []byte) error {
+	tmp, err := ioutil.TempFile(b.dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path(id))
+}
+
+func (b *dirBackend) Delete(id string) error {
+	err := os.Remove(b.path(id))
+	if os.IsNotExist(err) {
+		return errNotStored
+	}
+	return err
+}
+
+func (b *dirBackend) List() (map[string]time.Time, error) {
+	files, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]time.Time{}
+	for _, fi := range files {
+		if id := strings.TrimSuffix(fi.Name(), ".svg"); svgIDRE.MatchString(id) {
+			res[id] = fi.ModTime()
+		}
+	}
+	return res, nil
+}
+
+// svgStoreHandler uploads svgs with PUT /v1/svgs and returns and deletes them
+// with GET and DELETE /v1/svgs/{id}. Ids are the hash of the svg and shared by
+// everyone uploading it, so with api keys only the admin key may delete.
+func svgStoreHandler(st *svgStore, cfg *config) http.HandlerFunc {
+	h := cfg.keys.require("", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/svgs"), "/")
+		switch {
+		case id == "" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+			body, err := cfg.limits.readBody(r)
+			if err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			if _, err := rootElement(body); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, newError(http.StatusBadRequest, codeInvalidSVG, err), http.StatusBadRequest)
+				return
+			}
+			if id, err = st.Put(body); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			res := struct {
+				ID      string     `json:"id"`
+				Expires *time.Time `json:"expires,omitempty"`
+			}{ID: id}
+			if st.ttl > 0 {
+				t := time.Now().Add(st.ttl).UTC().Truncate(time.Second)
+				res.Expires = &t
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Location", "/v1/svgs/"+id)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(res)
+		case id != "" && r.Method == http.MethodGet:
+			data, err := st.Get(id)
+			if err != nil {
+				writeError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Header().Set("ETag", `"`+id+`"`)
+			w.Write(data)
+		default:
+			writeError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		}
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/svgs"), "/")
+		if id == "" || r.Method != http.MethodDelete {
+			h(w, r)
+			return
+		}
+		if cfg.keys != nil && !cfg.keys.isAdmin(r) {
+			writeError(w, r, newError(http.StatusUnauthorized, codeUnauthorized, errors.New("missing or wrong admin key")), http.StatusUnauthorized)
+			return
+		}
+		if !svgIDRE.MatchString(id) {
+			writeError(w, r, fmt.Errorf("svg '%s' not found", id), http.StatusNotFound)
+			return
+		}
+		err := st.backend.Delete(id)
+		if err == errNotStored {
+			writeError(w, r, fmt.Errorf("svg '%s' not found", id), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
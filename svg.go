@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// rootElement returns the root <svg> element of an SVG document
+func rootElement(data []byte) (xml.StartElement, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return xml.StartElement{}, errors.New("no root element found")
+		}
+		if err != nil {
+			return xml.StartElement{}, errors.Wrap(err, "could not parse svg")
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			if se.Name.Local != "svg" {
+				return xml.StartElement{}, fmt.Errorf("root element is <%s>, not <svg>", se.Name.Local)
+			}
+			return se, nil
+		}
+	}
+}
+
+func attr(se xml.StartElement, name string) string {
+	for _, a := range se.Attr {
+		if a.Name.Local == name && (a.Name.Space == "" || a.Name.Space == "http://www.w3.org/2000/svg") {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// findElement returns the element with the given id attribute
+func findElement(data []byte, id string) (xml.StartElement, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return xml.StartElement{}, fmt.Errorf("element '%s' not found", id)
+		}
+		if err != nil {
+			return xml.StartElement{}, errors.Wrap(err, "could not parse svg")
+		}
+		if se, ok := t.(xml.StartElement); ok && attr(se, "id") == id {
+			return se, nil
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// placeholders look like {{name}}, surrounding whitespace is ignored
+var placeholderRE = regexp.MustCompile(`{{\s*([A-Za-z0-9_.-]+)\s*}}`)
+
+var templateNameRE = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+type templateMap struct {
+	sync.RWMutex
+	m map[string][]byte
+}
+
+func NewTemplateMap() *templateMap {
+	return &templateMap{
+		m: map[string][]byte{},
+	}
+}
+
+func (tm *templateMap) Add(name string, d []byte) {
+	tm.Lock()
+	tm.m[name] = d
+	tm.Unlock()
+	logrus.Debugf("added template %s", name)
+}
+
+func (tm *templateMap) Remove(name string) bool {
+	tm.Lock()
+	_, ok := tm.m[name]
+	delete(tm.m, name)
+	tm.Unlock()
+	logrus.Debugf("removed template %s", name)
+	return ok
+}
+
+func (tm *templateMap) Get(name string) ([]byte, bool) {
+	tm.RLock()
+	d, ok := tm.m[name]
+	tm.RUnlock()
+	return d, ok
+}
+
+// LoadDir registers every *.svg in dir as template named after the file
+func (tm *templateMap) LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.svg"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		d, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if _, err := rootElement(d); err != nil {
+			return errors.Wrapf(err, "invalid template '%s'", f)
+		}
+		tm.Add(strings.TrimSuffix(filepath.Base(f), ".svg"), d)
+	}
+	return nil
+}
+
+// fillTemplate replaces all placeholders with the xml escaped values of the
+// record. Placeholders without a value are an error.
+func fillTemplate(tmpl []byte, record map[string]interface{}) ([]byte, error) {
+	var missing []string
+	res := placeholderRE.ReplaceAllFunc(tmpl, func(m []byte) []byte {
+		name := string(placeholderRE.FindSubmatch(m)[1])
+		v, ok := record[name]
+		if !ok {
+			missing = append(missing, name)
+			return nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			s = fmt.Sprint(v)
+		}
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(s))
+		return buf.Bytes()
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no value for placeholder(s) %s", strings.Join(missing, ", "))
+	}
+	return res, nil
+}
+
+// upper bound of records rendered for a single request
+const maxRecords = 100
+
+// readRecords parses a single json object or an array of at most maxRecords
+// of them. batch reports whether an array was sent.
+func readRecords(r *http.Request, l limits) (records []map[string]interface{}, batch bool, err error) {
+	body, err := l.readBody(r)
+	if err != nil {
+		return nil, false, err
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &records); err != nil {
+			return nil, true, err
+		}
+		if len(records) > maxRecords {
+			return nil, true, fmt.Errorf("%d records sent, at most %d are allowed", len(records), maxRecords)
+		}
+		return records, true, nil
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(body, &record); err != nil {
+		return nil, false, err
+	}
+	return []map[string]interface{}{record}, false, nil
+}
+
+// templateHandler manages templates and renders them:
+//
+//	PUT    /v1/templates/{name}      register the svg in the body (admin key)
+//	GET    /v1/templates/{name}      return the svg
+//	DELETE /v1/templates/{name}      remove the template (admin key)
+//	POST   /v1/templates/{name}/png  render a json record, or a zip for an
+//	                                 array of records
+//
+// Templates are shared by all api keys, so with api keys only the admin key
+// may change them.
+func templateHandler(templates *templateMap, rd *renderer, cfg *config) http.HandlerFunc {
+	h := cfg.keys.require("png", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v1/templates/")
+		name, render := strings.TrimSuffix(path, "/png"), strings.HasSuffix(path, "/png")
+		switch {
+		case render && r.Method == http.MethodPost:
+			tmpl, ok := templates.Get(name)
+			if !ok {
+				writeError(w, r, errors.New("template not found"), http.StatusNotFound)
+				return
+			}
+			renderTemplate(w, r, rd, cfg, tmpl)
+		case !render && r.Method == http.MethodGet:
+			tmpl, ok := templates.Get(name)
+			if !ok {
+				writeError(w, r, errors.New("template not found"), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write(tmpl)
+		default:
+			writeError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		}
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v1/templates/")
+		name, render := strings.TrimSuffix(path, "/png"), strings.HasSuffix(path, "/png")
+		if !templateNameRE.MatchString(name) {
+			writeError(w, r, errors.New("template not found"), http.StatusNotFound)
+			return
+		}
+		if render || r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			h(w, r)
+			return
+		}
+		if cfg.keys != nil && !cfg.keys.isAdmin(r) {
+			writeError(w, r, newError(http.StatusUnauthorized, codeUnauthorized, errors.New("missing or wrong admin key")), http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if !templates.Remove(name) {
+				writeError(w, r, errors.New("template not found"), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		body, err := cfg.limits.readBody(r)
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		if _, err := rootElement(body); err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		templates.Add(name, body)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// renderTemplate fills the template with the records of the request and
+// renders them. The file names in the zip of a batch are taken from the
+// record field given by the filename query parameter, if any. The render
+// deadline of the request (see config.timeout) applies to each record.
+func renderTemplate(w http.ResponseWriter, r *http.Request, rd *renderer, cfg *config, tmpl []byte) {
+	d, err := cfg.timeout(r)
+	if err != nil {
+		writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	deadline := func() (context.Context, context.CancelFunc) {
+		if d <= 0 {
+			return context.WithCancel(r.Context())
+		}
+		return context.WithTimeout(r.Context(), d)
+	}
+	records, batch, err := readRecords(r, cfg.limits)
+	if err != nil {
+		logrus.Warn(err)
+		writeError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	if len(records) == 0 {
+		writeError(w, r, errors.New("no records"), http.StatusBadRequest)
+		return
+	}
+	meta, status, err := queryMetadata(r.URL.Query())
+	if err != nil {
+		logrus.Warn(err)
+		writeError(w, r, err, status)
+		return
+	}
+	field := r.URL.Query().Get("filename")
+	seen := map[string]bool{}
+
+	var post postOptions
+	total := 0.0
+	res := make([][]byte, len(records))
+	names := make([]string, len(records))
+	before, after := 0, 0
+	for i, record := range records {
+		svg, err := fillTemplate(tmpl, record)
+		if err != nil {
+			err = errors.Wrapf(err, "record %d", i)
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		size, s, err := keySVGParams(r, svg, r.URL.Query(), cfg)
+		if err != nil {
+			err = errors.Wrapf(err, "record %d", i)
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		if post, err = cfg.postOptions(r, size, s); err != nil {
+			err = errors.Wrapf(err, "record %d", i)
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		pw, ph := post.outputSize(s.imageSize(size))
+		total += pw * ph
+		if err := cfg.checkTotal(r, total); err != nil {
+			err = errors.Wrapf(err, "record %d", i)
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusUnprocessableEntity)
+			return
+		}
+		ctx, cancel := deadline()
+		shots, err := rd.render(ctx, svg, size, s)
+		cancel()
+		if err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		if res[i], err = postProcess(shots[0], post); err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		before, after = before+len(shots[0]), after+len(res[i])
+		if res[i], err = meta.renderedBy(rd, chromeRenderer).embed(res[i], svg); err != nil {
+			logrus.Warn(err)
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		names[i] = fmt.Sprintf("%04d.png", i)
+		if v, ok := record[field]; ok && field != "" {
+			names[i] = zipFileName(fmt.Sprint(v)) + ".png"
+			if seen[names[i]] {
+				names[i] = fmt.Sprintf("%s-%04d.png", zipFileName(fmt.Sprint(v)), i)
+			}
+		}
+		seen[names[i]] = true
+	}
+
+	setBytesSaved(w, post, before, after)
+	if !batch {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(res[0])
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeZip(&buf, names, res); err != nil {
+		logrus.Warn(err)
+		writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="records.zip"`)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"net/url"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// parseTrimOptions reads trim=alpha|color|bbox, tolerance and padding from
+// the query into o. bbox is handled by the page, see inlineScript.
+func parseTrimOptions(q url.Values, o *postOptions) error {
+	switch t := q.Get("trim"); t {
+	case "", "bbox":
+	case "alpha", "color":
+		o.trim = t
+	default:
+		return fmt.Errorf("unsupported trim '%s', expected alpha, color or bbox", t)
+	}
+	if s := q.Get("tolerance"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 || v > 255 {
+			return fmt.Errorf("invalid tolerance '%s', must be between 0 and 255", s)
+		}
+		o.tolerance = v
+	}
+	if s := q.Get("padding"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 || v > 10000 {
+			return fmt.Errorf("invalid padding '%s'", s)
+		}
+		o.padding = v
+	}
+	return nil
+}
+
+// similar reports whether all channels of a and b differ by at most tolerance
+func similar(a, b color.NRGBA, tolerance int) bool {
+	d := func(x, y uint8) bool {
+		if x > y {
+			return int(x-y) <= tolerance
+		}
+		return int(y-x) <= tolerance
+	}
+	return d(a.R, b.R) && d(a.G, b.G) && d(a.B, b.B) && d(a.A, b.A)
+}
+
+// contentBounds returns the bounds of everything that is not background.
+// With mode alpha the background is transparent, with mode color it is the
+// color of the top left pixel.
+func contentBounds(img *image.NRGBA, mode string, tolerance int) image.Rectangle {
+	b := img.Bounds()
+	if b.Empty() {
+		return b
+	}
+	bg := img.NRGBAAt(b.Min.X, b.Min.Y)
+	isBackground := func(x, y int) bool {
+		c := img.NRGBAAt(x, y)
+		if mode == "alpha" {
+			return int(c.A) <= tolerance
+		}
+		return similar(c, bg, tolerance)
+	}
+
+	content := image.Rectangle{}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !isBackground(x, y) {
+				content = content.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return content
+}
+
+// trimImage crops img to its content, see contentBounds. Images without any
+// content are returned unchanged.
+func trimImage(img image.Image, mode string, tolerance int) image.Image {
+	src := imaging.Clone(img)
+	content := contentBounds(src, mode, tolerance)
+	if content.Empty() {
+		return src
+	}
+	return imaging.Crop(src, content)
+}
+
+// padImage adds a transparent margin of n pixels on all sides
+func padImage(img image.Image, n int) image.Image {
+	b := img.Bounds()
+	dst := imaging.New(b.Dx()+2*n, b.Dy()+2*n, color.Transparent)
+	return imaging.Paste(dst, img, image.Pt(n, n))
+}
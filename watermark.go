@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/disintegration/imaging"
+	"github.com/pkg/errors"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var anchors = map[string]imaging.Anchor{
+	"center":       imaging.Center,
+	"top-left":     imaging.TopLeft,
+	"top":          imaging.Top,
+	"top-right":    imaging.TopRight,
+	"left":         imaging.Left,
+	"right":        imaging.Right,
+	"bottom-left":  imaging.BottomLeft,
+	"bottom":       imaging.Bottom,
+	"bottom-right": imaging.BottomRight,
+}
+
+type watermarkMap struct {
+	sync.RWMutex
+	m map[string]image.Image
+}
+
+func NewWatermarkMap() *watermarkMap {
+	return &watermarkMap{
+		m: map[string]image.Image{},
+	}
+}
+
+func (wm *watermarkMap) Add(name string, img image.Image) {
+	wm.Lock()
+	wm.m[name] = img
+	wm.Unlock()
+	logrus.Debugf("added watermark %s", name)
+}
+
+func (wm *watermarkMap) Remove(name string) bool {
+	wm.Lock()
+	_, ok := wm.m[name]
+	delete(wm.m, name)
+	wm.Unlock()
+	logrus.Debugf("removed watermark %s", name)
+	return ok
+}
+
+func (wm *watermarkMap) Get(name string) (image.Image, bool) {
+	wm.RLock()
+	img, ok := wm.m[name]
+	wm.RUnlock()
+	return img, ok
+}
+
+// LoadDir registers every *.png in dir as watermark named after the file
+func (wm *watermarkMap) LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.png"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		d, err := ioutil.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		img, err := png.Decode(bytes.NewReader(d))
+		if err != nil {
+			return errors.Wrapf(err, "invalid watermark '%s'", f)
+		}
+		wm.Add(strings.TrimSuffix(filepath.Base(f), ".png"), img)
+	}
+	return nil
+}
+
+// watermark is composited over the output of a request
+type watermark struct {
+	img     image.Image
+	anchor  imaging.Anchor
+	opacity float64
+	tile    bool
+}
+
+// textImage renders text in white with a dark outline, scaled to the given
+// height in pixels
+func textImage(text string, height int) image.Image {
+	face := basicfont.Face7x13
+	w := font.MeasureString(face, text).Ceil() + 2
+	h := face.Metrics().Height.Ceil() + 2
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	dot := fixed.P(1, 1+face.Metrics().Ascent.Ceil())
+	for _, d := range []struct {
+		dx, dy int
+		c      color.Color
+	}{{-1, 0, color.Black}, {1, 0, color.Black}, {0, -1, color.Black}, {0, 1, color.Black}, {0, 0, color.White}} {
+		dr := &font.Drawer{Dst: img, Src: image.NewUniform(d.c), Face: face, Dot: dot.Add(fixed.P(d.dx, d.dy))}
+		dr.DrawString(text)
+	}
+	if height <= 0 || height == h {
+		return img
+	}
+	return imaging.Resize(img, 0, height, imaging.Linear)
+}
+
+// anchorPoint returns the position of a w x h image anchored in b
+func anchorPoint(b image.Rectangle, w, h int, anchor imaging.Anchor) image.Point {
+	x := map[imaging.Anchor]int{
+		imaging.TopLeft: 0, imaging.Left: 0, imaging.BottomLeft: 0,
+		imaging.Top: 1, imaging.Center: 1, imaging.Bottom: 1,
+		imaging.TopRight: 2, imaging.Right: 2, imaging.BottomRight: 2,
+	}[anchor]
+	y := map[imaging.Anchor]int{
+		imaging.TopLeft: 0, imaging.Top: 0, imaging.TopRight: 0,
+		imaging.Left: 1, imaging.Center: 1, imaging.Right: 1,
+		imaging.BottomLeft: 2, imaging.Bottom: 2, imaging.BottomRight: 2,
+	}[anchor]
+	return image.Pt(b.Min.X+x*(b.Dx()-w)/2, b.Min.Y+y*(b.Dy()-h)/2)
+}
+
+// at most this many tiles are composited, smaller marks are spaced further
+// apart
+const maxWatermarkTiles = 1000
+
+// apply composites the watermark over img, either once at the anchor or
+// tiled over the whole image
+func (wm *watermark) apply(img image.Image) image.Image {
+	b := img.Bounds()
+	mark := wm.img
+	if mb := mark.Bounds(); mb.Dx() > b.Dx() || mb.Dy() > b.Dy() {
+		mark = imaging.Fit(mark, b.Dx(), b.Dy(), imaging.Lanczos)
+	}
+	mw, mh := mark.Bounds().Dx(), mark.Bounds().Dy()
+	if mw == 0 || mh == 0 {
+		return img
+	}
+	dst := imaging.Clone(img)
+	alpha := image.NewUniform(color.Alpha{uint8(math.Round(wm.opacity * 255))})
+	put := func(p image.Point) {
+		r := image.Rectangle{p, p.Add(image.Pt(mw, mh))}
+		draw.DrawMask(dst, r, mark, mark.Bounds().Min, alpha, image.Point{}, draw.Over)
+	}
+	if !wm.tile {
+		put(anchorPoint(dst.Bounds(), mw, mh, wm.anchor))
+		return dst
+	}
+	// tiles are separated by half their size in both directions
+	stepX, stepY := mw+mw/2, mh+mh/2
+	for (b.Dx()/stepX+1)*(b.Dy()/stepY+1) > maxWatermarkTiles {
+		stepX, stepY = stepX*2, stepY*2
+	}
+	for y := 0; y < b.Dy(); y += stepY {
+		for x := (y / stepY % 2) * stepX / 2; x < b.Dx(); x += stepX {
+			put(image.Pt(x, y))
+		}
+	}
+	return dst
+}
+
+// minWatermarkSize is the smallest watermark-size in pixels
+const minWatermarkSize = 8
+
+// parseWatermark reads watermark=<name>, watermark-text, watermark-size,
+// watermark-position, watermark-opacity and watermark-tile from the query.
+// enforced is the watermark spec of the api key, if any, which takes
+// precedence: either a registered name or "text:<text>".
+func parseWatermark(q url.Values, watermarks *watermarkMap, enforced string) (*watermark, error) {
+	name, text := q.Get("watermark"), q.Get("watermark-text")
+	if enforced != "" {
+		name, text = enforced, ""
+		if strings.HasPrefix(enforced, "text:") {
+			name, text = "", strings.TrimPrefix(enforced, "text:")
+		}
+	}
+	if name == "" && text == "" {
+		return nil, nil
+	}
+	// enforced watermarks can not be moved, resized or made invisible by the
+	// client
+	wm := &watermark{anchor: imaging.Center, opacity: 0.5, tile: enforced != ""}
+	if enforced == "" {
+		if p := q.Get("watermark-position"); p != "" {
+			a, ok := anchors[p]
+			if !ok {
+				return nil, fmt.Errorf("unsupported watermark-position '%s'", p)
+			}
+			wm.anchor = a
+		}
+		if s := q.Get("watermark-opacity"); s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil || v < 0 || v > 1 {
+				return nil, fmt.Errorf("invalid watermark-opacity '%s', must be between 0 and 1", s)
+			}
+			wm.opacity = v
+		}
+		if s := q.Get("watermark-tile"); s != "" {
+			v, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid watermark-tile '%s'", s)
+			}
+			wm.tile = v
+		}
+	}
+
+	if name != "" {
+		img, ok := watermarks.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown watermark '%s'", name)
+		}
+		wm.img = img
+		return wm, nil
+	}
+	size := 24
+	if s := q.Get("watermark-size"); s != "" && enforced == "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < minWatermarkSize || v > 1000 {
+			return nil, fmt.Errorf("invalid watermark-size '%s'", s)
+		}
+		size = v
+	}
+	wm.img = textImage(text, size)
+	return wm, nil
+}
+
+// parseWatermarkKeys parses the csv list of apikey=watermark pairs
+func parseWatermarkKeys(s string) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid watermark key '%s', expected key=watermark", kv)
+		}
+		keys[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return keys, nil
+}
+
+// watermarkHandler manages the registered watermark images:
+//
+//	PUT    /v1/watermarks/{name}  register the png in the body (admin key)
+//	GET    /v1/watermarks/{name}  return the png
+//	DELETE /v1/watermarks/{name}  remove the watermark (admin key)
+func watermarkHandler(cfg *config) http.HandlerFunc {
+	get := cfg.keys.require("", func(w http.ResponseWriter, r *http.Request) {
+		img, ok := cfg.watermarks.Get(strings.TrimPrefix(r.URL.Path, "/v1/watermarks/"))
+		if !ok {
+			writeError(w, r, errors.New("watermark not found"), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, img)
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/v1/watermarks/")
+		if !templateNameRE.MatchString(name) {
+			writeError(w, r, errors.New("watermark not found"), http.StatusNotFound)
+			return
+		}
+		if (r.Method == http.MethodPut || r.Method == http.MethodDelete) && !cfg.keys.isAdmin(r) {
+			writeError(w, r, newError(http.StatusUnauthorized, codeUnauthorized, errors.New("missing or wrong admin key")), http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			body, err := cfg.limits.readBody(r)
+			if err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusBadRequest)
+				return
+			}
+			c, _, err := image.DecodeConfig(bytes.NewReader(body))
+			if err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusBadRequest)
+				return
+			}
+			if err := cfg.limits.checkPixels(float64(c.Width), float64(c.Height)); err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusUnprocessableEntity)
+				return
+			}
+			img, _, err := image.Decode(bytes.NewReader(body))
+			if err != nil {
+				logrus.Warn(err)
+				writeError(w, r, err, http.StatusBadRequest)
+				return
+			}
+			cfg.watermarks.Add(name, img)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			get(w, r)
+		case http.MethodDelete:
+			if !cfg.watermarks.Remove(name) {
+				writeError(w, r, errors.New("watermark not found"), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		}
+	}
+}